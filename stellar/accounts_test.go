@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestUpdateAccount_keepsUntouchedPolicies(t *testing.T) {
+	b, storage := getTestBackend(t)
+	account := randomAccount(t)
+	whitelisted := randomAccount(t)
+	account.TxSpendLimit = "1000"
+	account.Whitelist = []string{whitelisted.Address}
+	account.AllowedAssets = []string{"native"}
+	account.ApprovalThreshold = "500"
+	account.ApprovalQuorum = 2
+	account.ApprovalTTL = 3600
+	account.FeeBumpMaxFee = 10000
+	account.SponsorshipLimit = 3
+	entry, err := logical.StorageEntryJSON("accounts/x", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/x",
+		Data:      map[string]interface{}{"offer_price_band": "0.05"},
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	updated, err := b.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: storage}, "accounts/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.OfferPriceBand != "0.05" {
+		t.Fatalf("expected offer_price_band to be updated, got %s", updated.OfferPriceBand)
+	}
+	if updated.Seed != account.Seed {
+		t.Fatal("expected the keys of the account to be kept")
+	}
+	if updated.TxSpendLimit != "1000" || updated.ApprovalThreshold != "500" || updated.ApprovalQuorum != 2 ||
+		updated.ApprovalTTL != 3600 || updated.FeeBumpMaxFee != 10000 || updated.SponsorshipLimit != 3 {
+		t.Fatalf("expected the limits to be kept, got %+v", updated)
+	}
+	if len(updated.Whitelist) != 1 || updated.Whitelist[0] != whitelisted.Address ||
+		len(updated.AllowedAssets) != 1 || updated.AllowedAssets[0] != "native" {
+		t.Fatalf("expected the lists to be kept, got %+v", updated)
+	}
+}
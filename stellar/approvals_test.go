@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stellar/go/txnbuild"
+)
+
+// storeTestApproval stores a payment from the source account waiting for a quorum of approvers
+func storeTestApproval(t *testing.T, b *backend, storage logical.Storage, id string, quorum int, expiresAt time.Time) {
+	source := storeTestAccount(t, storage, "source")
+	mockSourceAccount(t, b, source)
+
+	tx, err := txnbuild.NewTransaction(txnbuild.TransactionParams{
+		SourceAccount:        &txnbuild.SimpleAccount{AccountID: source.Address, Sequence: 1},
+		IncrementSequenceNum: true,
+		Operations:           []txnbuild.Operation{&txnbuild.Payment{Destination: randomAccount(t).Address, Amount: "500", Asset: txnbuild.NativeAsset{}}},
+		BaseFee:              txnbuild.MinBaseFee,
+		Preconditions:        txnbuild.Preconditions{TimeBounds: txnbuild.NewInfiniteTimeout()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := tx.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.storeApproval(context.Background(), &logical.Request{Storage: storage}, &Approval{
+		ID:          id,
+		Account:     "source",
+		Signers:     []string{"source"},
+		Transaction: envelope,
+		Options:     &transactionOptions{BaseFee: txnbuild.MinBaseFee, Timeout: 300},
+		Requester:   "requester",
+		Quorum:      quorum,
+		Status:      approvalPending,
+		CreatedAt:   time.Now(),
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decideApproval approves or rejects the approval as the entity, returning its status or the error
+func decideApproval(t *testing.T, b logical.Backend, storage logical.Storage, id string, decision string, entityID string) (string, error) {
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "approvals/" + id + "/" + decision,
+		Storage:   storage,
+		EntityID:  entityID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	return resp.Data["status"].(string), nil
+}
+
+func TestApprovals_quorum(t *testing.T) {
+	b, storage := getTestBackend(t)
+	storeTestApproval(t, b.(*backend), storage, "payout", 2, time.Now().Add(time.Hour))
+
+	status, err := decideApproval(t, b, storage, "payout", "approve", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != approvalPending {
+		t.Fatalf("expected one approval to be short of the quorum, got %s", status)
+	}
+
+	// Neither the requester nor an approver who already approved count towards the quorum
+	if _, err := decideApproval(t, b, storage, "payout", "approve", "requester"); errorCode(err) != 403 {
+		t.Fatalf("expected the requester to be refused, got %v", err)
+	}
+	if _, err := decideApproval(t, b, storage, "payout", "approve", "alice"); errorCode(err) != 409 {
+		t.Fatalf("expected a second approval by the same entity to be refused, got %v", err)
+	}
+	if _, err := decideApproval(t, b, storage, "payout", "approve", ""); errorCode(err) != 403 {
+		t.Fatalf("expected an approval without an entity to be refused, got %v", err)
+	}
+
+	status, err = decideApproval(t, b, storage, "payout", "approve", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != approvalApproved {
+		t.Fatalf("expected the quorum to be reached, got %s", status)
+	}
+	approval, err := b.(*backend).readStoredApproval(context.Background(), &logical.Request{Storage: storage}, "payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approval.SignedTransaction == "" || approval.TransactionHash == "" || len(approval.Approvers) != 2 {
+		t.Fatalf("expected the transaction to be signed once approved, got %+v", approval)
+	}
+
+	// A decided transaction can't be approved again
+	if _, err := decideApproval(t, b, storage, "payout", "approve", "carol"); errorCode(err) != 409 {
+		t.Fatalf("expected an approved transaction to be final, got %v", err)
+	}
+}
+
+func TestApprovals_reject(t *testing.T) {
+	b, storage := getTestBackend(t)
+	storeTestApproval(t, b.(*backend), storage, "payout", 2, time.Now().Add(time.Hour))
+
+	if _, err := decideApproval(t, b, storage, "payout", "reject", "requester"); errorCode(err) != 403 {
+		t.Fatalf("expected the requester to be refused, got %v", err)
+	}
+	status, err := decideApproval(t, b, storage, "payout", "reject", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != approvalRejected {
+		t.Fatalf("expected the transaction to be rejected, got %s", status)
+	}
+	if _, err := decideApproval(t, b, storage, "payout", "approve", "bob"); errorCode(err) != 409 {
+		t.Fatalf("expected a rejected transaction not to be approved, got %v", err)
+	}
+}
+
+func TestApprovals_expiry(t *testing.T) {
+	b, storage := getTestBackend(t)
+	storeTestApproval(t, b.(*backend), storage, "payout", 1, time.Now().Add(-time.Minute))
+
+	if _, err := decideApproval(t, b, storage, "payout", "approve", "alice"); errorCode(err) != 409 {
+		t.Fatalf("expected an expired transaction not to be approved, got %v", err)
+	}
+	approval, err := b.(*backend).readStoredApproval(context.Background(), &logical.Request{Storage: storage}, "payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approval.Status != approvalExpired || approval.SignedTransaction != "" {
+		t.Fatalf("expected the transaction to be expired and unsigned, got %+v", approval)
+	}
+}
+
+func TestCreateApproval_requiresEntity(t *testing.T) {
+	b, storage := getTestBackend(t)
+	account := randomAccount(t)
+	account.ApprovalThreshold = "100"
+
+	_, err := b.(*backend).createApproval(context.Background(), &logical.Request{Storage: storage}, nil, nil, nil, nil, "source", account, []string{"source"})
+	if errorCode(err) != 403 {
+		t.Fatalf("expected a request without an entity to be refused, got %v", err)
+	}
+	approvals, err := storage.List(context.Background(), "approvals/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(approvals) != 0 {
+		t.Fatalf("expected no approval to be stored, got %v", approvals)
+	}
+}
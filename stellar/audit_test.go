@@ -0,0 +1,203 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// putTestAuditRecord stores an audit record signed at the given time
+func putTestAuditRecord(t *testing.T, storage logical.Storage, signedAt time.Time, record *AuditRecord) {
+	record.ID = fmt.Sprintf("%019d-1234abcd", signedAt.UnixNano())
+	record.CreatedAt = signedAt.UTC()
+	entry, err := logical.StorageEntryJSON("audit/transactions/"+record.ID, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreAuditRecord(t *testing.T) {
+	b, storage := getTestBackend(t)
+	req := &logical.Request{Storage: storage, Path: "payments"}
+
+	var stored []string
+	for _, record := range []*AuditRecord{
+		{TransactionHash: "aaaa"},
+		{TransactionHash: "bbbb", Untracked: true},
+		{},
+	} {
+		if err := b.(*backend).storeAuditRecord(context.Background(), req, record); err != nil {
+			t.Fatal(err)
+		}
+		signedAt, ok := auditRecordTime(record.ID)
+		if !ok || !signedAt.Equal(record.CreatedAt) {
+			t.Fatalf("expected id %s to encode the signing time %v", record.ID, record.CreatedAt)
+		}
+		if record.Path != "payments" {
+			t.Fatalf("expected the request path to be recorded, got %s", record.Path)
+		}
+		stored = append(stored, record.ID)
+	}
+
+	ids, err := storage.List(context.Background(), "audit/transactions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != fmt.Sprint(stored) {
+		t.Fatalf("expected ids to sort in signing order, got %v", stored)
+	}
+
+	// Only transactions which can be submitted are tracked
+	for hash, tracked := range map[string]bool{"aaaa": true, "bbbb": false} {
+		status, err := b.(*backend).readStoredTransactionStatus(context.Background(), storage, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (status != nil) != tracked {
+			t.Fatalf("expected tracking of %s to be %v", hash, tracked)
+		}
+	}
+}
+
+func TestAuditRecordTime(t *testing.T) {
+	signedAt := time.Date(2019, 6, 1, 12, 0, 0, 42, time.UTC)
+	parsed, ok := auditRecordTime(fmt.Sprintf("%019d-1234abcd", signedAt.UnixNano()))
+	if !ok || !parsed.Equal(signedAt) {
+		t.Fatalf("expected %v, got %v", signedAt, parsed)
+	}
+	if _, ok := auditRecordTime("not-a-time"); ok {
+		t.Fatal("expected an id without a time to be refused")
+	}
+}
+
+func TestListAuditRecords_filters(t *testing.T) {
+	b, storage := getTestBackend(t)
+	alice := randomAccount(t)
+	bob := randomAccount(t)
+	putTestAccount(t, storage, "alice", alice)
+
+	now := time.Now()
+	putTestAuditRecord(t, storage, now.Add(-3*time.Hour), &AuditRecord{TransactionHash: "a1", Accounts: []string{alice.Address}})
+	putTestAuditRecord(t, storage, now.Add(-2*time.Hour), &AuditRecord{TransactionHash: "b22", Accounts: []string{bob.Address}})
+	putTestAuditRecord(t, storage, now.Add(-time.Hour), &AuditRecord{TransactionHash: "ab333", Accounts: []string{alice.Address, bob.Address}})
+
+	tests := []struct {
+		name   string
+		data   map[string]interface{}
+		hashes []string
+	}{
+		{"all", nil, []string{"a1", "b22", "ab333"}},
+		{"account name", map[string]interface{}{"account": "alice"}, []string{"a1", "ab333"}},
+		{"address", map[string]interface{}{"account": bob.Address}, []string{"b22", "ab333"}},
+		{"hash", map[string]interface{}{"hash": "B22"}, []string{"b22"}},
+		{"start", map[string]interface{}{"start": now.Add(-2 * time.Hour).Format(time.RFC3339Nano)}, []string{"b22", "ab333"}},
+		{"end", map[string]interface{}{"end": now.Add(-2 * time.Hour).Format(time.RFC3339Nano)}, []string{"a1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ListOperation,
+				Path:      "audit/transactions/",
+				Data:      test.data,
+				Storage:   storage,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, _ := resp.Data["keys"].([]string)
+			infos := resp.Data["key_info"].(map[string]interface{})
+			var hashes []string
+			for _, key := range keys {
+				hashes = append(hashes, infos[key].(map[string]interface{})["transaction_hash"].(string))
+			}
+			if fmt.Sprint(hashes) != fmt.Sprint(test.hashes) {
+				t.Fatalf("expected %v, got %v", test.hashes, hashes)
+			}
+		})
+	}
+
+	if _, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "audit/transactions/",
+		Data:      map[string]interface{}{"start": "yesterday"},
+		Storage:   storage,
+	}); errorCode(err) != 400 {
+		t.Fatalf("expected an invalid start to be refused, got %v", err)
+	}
+}
+
+func TestPruneAuditRecords(t *testing.T) {
+	b, storage := getTestBackend(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	old := &AuditRecord{TransactionHash: "old"}
+	putTestAuditRecord(t, storage, now.Add(-2*time.Hour), old)
+	recent := &AuditRecord{TransactionHash: "recent"}
+	putTestAuditRecord(t, storage, now.Add(-30*time.Minute), recent)
+	for _, hash := range []string{"old", "recent"} {
+		if err := b.(*backend).storeTransactionStatus(ctx, storage, &TransactionStatus{TransactionHash: hash, Status: txStatusPending}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Records are kept forever by default
+	if err := b.(*backend).pruneAuditRecords(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := storage.List(ctx, "audit/transactions/"); len(ids) != 2 {
+		t.Fatalf("expected no records to be pruned without a retention, got %v", ids)
+	}
+
+	entry, err := logical.StorageEntryJSON("config", &Config{AuditRetention: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.(*backend).pruneAuditRecords(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := storage.List(ctx, "audit/transactions/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != recent.ID {
+		t.Fatalf("expected only the recent record to be kept, got %v", ids)
+	}
+	for hash, kept := range map[string]bool{"old": false, "recent": true} {
+		status, err := b.(*backend).readStoredTransactionStatus(ctx, storage, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (status != nil) != kept {
+			t.Fatalf("expected the status of %s to be kept: %v", hash, kept)
+		}
+	}
+}
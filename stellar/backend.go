@@ -22,10 +22,63 @@ import (
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/federation"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/clients/stellartoml"
+	"github.com/stellar/go/network"
+	"log"
+	"sync"
 )
 
 type backend struct {
 	*framework.Backend
+
+	// Horizon client used to load account state and network information
+	horizon horizonclient.ClientInterface
+
+	// Passphrase of the Stellar network that transactions are signed for
+	networkPassphrase string
+
+	// Cached signers and thresholds of the source accounts of signed transactions
+	signerCache     map[string]*accountSigners
+	signerCacheLock sync.RWMutex
+
+	// Cached SEP-29 memo requirements of payment destinations
+	memoRequiredCache     map[string]*memoRequirement
+	memoRequiredCacheLock sync.RWMutex
+
+	// Serializes approval decisions so that concurrent approvals are all counted
+	approvalLock sync.Mutex
+
+	// Serializes updates of the daily fee budgets of fee accounts
+	feeBudgetLock sync.Mutex
+
+	// Serializes sponsorships so that sponsor limits hold under concurrent requests
+	sponsorshipLock sync.Mutex
+
+	// Serializes the issue of accounts so that the lease limits of roles hold under concurrent requests
+	credsLock sync.Mutex
+
+	// Resolves federation addresses, and caches the resolved destinations
+	federation          federationResolver
+	federationCache     map[string]*federationDestination
+	federationCacheLock sync.Mutex
+
+	// Fetches the stellar.toml of the origin domains of SEP-7 URIs
+	stellarToml stellarTomlResolver
+
+	// Serializes changes of federation names so that they stay unique
+	federationLock sync.Mutex
+
+	// Serializes the allocation of wallet indexes
+	walletLock sync.Mutex
+
+	// Serializes changes of sub-account balances
+	subaccountLock sync.Mutex
+
+	// Idempotency keys of the requests being handled
+	idempotencyInFlight map[string]bool
+	idempotencyLock     sync.Mutex
 }
 
 // Factory creates a new usable instance of this secrets engine.
@@ -39,15 +92,66 @@ func Factory(ctx context.Context, c *logical.BackendConfig) (logical.Backend, er
 
 func Backend() *backend {
 	var b backend
+	b.horizon = horizonclient.DefaultTestNetClient
+	b.networkPassphrase = network.TestNetworkPassphrase
+	b.signerCache = make(map[string]*accountSigners)
+	b.idempotencyInFlight = make(map[string]bool)
+	b.memoRequiredCache = make(map[string]*memoRequirement)
+	b.federation = federation.DefaultTestNetClient
+	b.federationCache = make(map[string]*federationDestination)
+	b.stellarToml = stellartoml.DefaultClient
 	b.Backend = &framework.Backend{
 		Help: "",
 		Paths: framework.PathAppend(
+			configPaths(&b),
 			accountsPaths(&b),
 			paymentsPaths(&b),
+			claimableBalancesPaths(&b),
+			offersPaths(&b),
+			liquidityPoolsPaths(&b),
+			signersPaths(&b),
+			approvalsPaths(&b),
+			feeBumpPaths(&b),
+			sponsorshipsPaths(&b),
+			rolesPaths(&b),
+			credsPaths(&b),
+			auditPaths(&b),
+			transactionsPaths(&b),
+			sep10Paths(&b),
+			walletsPaths(&b),
+			federationPaths(&b),
+			uriPaths(&b),
+			messagesPaths(&b),
+			encryptionPaths(&b),
+			muxedPaths(&b),
+			subaccountsPaths(&b),
 		),
 		PathsSpecial: &logical.Paths{},
-		Secrets:      []*framework.Secret{},
+		Secrets: []*framework.Secret{
+			secretAccount(&b),
+		},
 		BackendType:  logical.TypeLogical,
+		PeriodicFunc: b.periodic,
 	}
 	return &b
 }
+
+// periodic runs the backend housekeeping. A failing step is logged and doesn't keep the others from running.
+func (b *backend) periodic(ctx context.Context, req *logical.Request) error {
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"reconcile transactions", func() error { return b.reconcileTransactions(ctx, req.Storage) }},
+		{"prune transaction statuses", func() error { return b.pruneTransactionStatuses(ctx, req.Storage) }},
+		{"prune idempotent responses", func() error { return b.pruneIdempotentResponses(ctx, req.Storage) }},
+		{"sync sub-accounts", func() error { return b.syncAllSubaccounts(ctx, req) }},
+		{"prune audit records", func() error { return b.pruneAuditRecords(ctx, req.Storage) }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			log.Printf("failed to %s: %v", step.name, err)
+		}
+	}
+	return nil
+}
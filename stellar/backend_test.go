@@ -18,12 +18,15 @@ package stellar
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 	"time"
 
 	"fmt"
 	"github.com/hashicorp/vault/logical"
-	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	hProtocol "github.com/stellar/go/protocols/horizon"
 )
 
 const (
@@ -35,11 +38,11 @@ const (
 type testData struct {
 	B      logical.Backend
 	S      logical.Storage
-	Client horizon.Client
+	Client *horizonclient.Client
 }
 
 func setupTest(t *testing.T) *testData {
-	horizonClient := *horizon.DefaultTestNetClient
+	horizonClient := horizonclient.DefaultTestNetClient
 	b, reqStorage := getTestBackend(t)
 	return &testData{
 		B:      b,
@@ -66,6 +69,63 @@ func getTestBackend(t *testing.T) (logical.Backend, logical.Storage) {
 	return b, config.StorageView
 }
 
+// randomAccount returns an account with a random keypair, which doesn't exist on the network
+func randomAccount(t *testing.T) *Account {
+	kp, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Account{Address: kp.Address(), Seed: kp.Seed(), AccountId: kp.Address()}
+}
+
+// storeTestAccount stores a random account under the name, without creating it on the network
+func storeTestAccount(t *testing.T, storage logical.Storage, name string) *Account {
+	account := randomAccount(t)
+	putTestAccount(t, storage, name, account)
+	return account
+}
+
+// putTestAccount stores the account under the name
+func putTestAccount(t *testing.T, storage logical.Storage, name string, account *Account) {
+	entry, err := logical.StorageEntryJSON("accounts/"+name, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errorCode returns the HTTP status of a coded error, or 0
+func errorCode(err error) int {
+	if coded, ok := err.(logical.HTTPCodedError); ok {
+		return coded.Code()
+	}
+	return 0
+}
+
+// mockSourceAccount makes the backend load the account from a mock Horizon client, with the account as its only
+// signer, so that transactions from it can be built and signed without the network
+func mockSourceAccount(t *testing.T, b *backend, account *Account) {
+	var details hProtocol.Account
+	data := fmt.Sprintf(`{"id": %q, "account_id": %q, "sequence": "41"}`, account.Address, account.Address)
+	if err := json.Unmarshal([]byte(data), &details); err != nil {
+		t.Fatal(err)
+	}
+
+	client, ok := b.horizon.(*horizonclient.MockClient)
+	if !ok {
+		client = &horizonclient.MockClient{}
+		b.horizon = client
+	}
+	client.On("AccountDetail", horizonclient.AccountRequest{AccountID: account.Address}).Return(details, nil)
+
+	b.signerCache[account.Address] = &accountSigners{
+		weights:  map[string]int32{account.Address: 1},
+		loadedAt: time.Now(),
+	}
+}
+
 func TestBackend_createAccount(t *testing.T) {
 
 	td := setupTest(t)
@@ -87,7 +147,7 @@ func TestBackend_submitPayment(t *testing.T) {
 		t.Fatalf("expected signedTx data not present in createPayment")
 	}
 
-	response, err := td.Client.SubmitTransaction(signedTx.(string))
+	response, err := td.Client.SubmitTransactionXDR(signedTx.(string))
 	if err != nil {
 		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
 	}
@@ -108,7 +168,7 @@ func TestBackend_submitPaymentAboveLimit(t *testing.T) {
 		t.Fatalf("expected signedTx data not present in createPayment")
 	}
 
-	response, err := td.Client.SubmitTransaction(signedTx.(string))
+	response, err := td.Client.SubmitTransactionXDR(signedTx.(string))
 	if err != nil {
 		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
 	}
@@ -130,7 +190,7 @@ func TestBackend_submitPaymentUsingChannel(t *testing.T) {
 		t.Fatalf("expected signedTx data not present in createPayment")
 	}
 
-	response, err := td.Client.SubmitTransaction(signedTx.(string))
+	response, err := td.Client.SubmitTransactionXDR(signedTx.(string))
 	if err != nil {
 		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
 	}
@@ -157,7 +217,62 @@ func TestBackend_submitPaymentUsingChannelAndAdditionalSigners(t *testing.T) {
 		t.Fatalf("expected signedTx data not present in createPayment")
 	}
 
-	response, err := td.Client.SubmitTransaction(signedTx.(string))
+	response, err := td.Client.SubmitTransactionXDR(signedTx.(string))
+	if err != nil {
+		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
+	}
+
+	t.Logf("transaction posted in ledger: %v", response.Ledger)
+}
+
+func TestBackend_submitClaimableBalance(t *testing.T) {
+
+	td := setupTest(t)
+	createAccount(td, "testSourceAccount", t)
+	createAccount(td, "testDestinationAccount", t)
+
+	claimants := `[{"destination":"testDestinationAccount","predicate":{"type":"before_relative_time","seconds":86400}},` +
+		`{"destination":"testSourceAccount","predicate":{"type":"not","predicates":[{"type":"before_relative_time","seconds":86400}]}}]`
+
+	resp, err := td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "claimable_balances",
+		Data: map[string]interface{}{
+			"source":    "testSourceAccount",
+			"claimants": claimants,
+			"assetCode": "native",
+			"amount":    "10",
+		},
+		Storage: td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to create claimable balance: %v", err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	if _, err := td.Client.SubmitTransactionXDR(resp.Data["signed_transaction"].(string)); err != nil {
+		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
+	}
+
+	resp, err = td.B.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "claimable_balances/claim",
+		Data: map[string]interface{}{
+			"account":   "testDestinationAccount",
+			"balanceId": resp.Data["balance_id"],
+		},
+		Storage: td.S,
+	})
+	if err != nil {
+		t.Fatalf("failed to claim claimable balance: %v", err)
+	}
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	response, err := td.Client.SubmitTransactionXDR(resp.Data["signed_transaction"].(string))
 	if err != nil {
 		t.Fatalf("failed to submit transaction to testnet: %v", errorString(err))
 	}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stellar/go/clients/horizonclient"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/support/render/problem"
+)
+
+func TestRevokeCreds_alreadyMerged(t *testing.T) {
+	b, storage := getTestBackend(t)
+	funding := storeTestAccount(t, storage, "funding")
+	issued := randomAccount(t)
+	issued.Role = "temp"
+	putTestAccount(t, storage, "creds-temp-1234abcd", issued)
+
+	// The issued account no longer exists on the network
+	client := &horizonclient.MockClient{}
+	client.On("AccountDetail", horizonclient.AccountRequest{AccountID: issued.Address}).
+		Return(hProtocol.Account{}, &horizonclient.Error{Problem: problem.P{Status: 404}})
+	b.(*backend).horizon = client
+
+	req := &logical.Request{
+		Storage: storage,
+		Secret: &logical.Secret{InternalData: map[string]interface{}{
+			"account_name":    "creds-temp-1234abcd",
+			"role":            "temp",
+			"funding_address": funding.Address,
+		}},
+	}
+	if _, err := b.(*backend).revokeCreds(context.Background(), req, nil); err != nil {
+		t.Fatal(err)
+	}
+	account, err := b.(*backend).readVaultAccount(context.Background(), req, "accounts/creds-temp-1234abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account != nil {
+		t.Fatal("expected the key of the revoked account to be deleted")
+	}
+
+	// Revoking again finds nothing to do
+	if _, err := b.(*backend).revokeCreds(context.Background(), req, nil); err != nil {
+		t.Fatal(err)
+	}
+	client.AssertNumberOfCalls(t, "AccountDetail", 1)
+}
+
+func TestRevokeCreds_missingInternalData(t *testing.T) {
+	b, storage := getTestBackend(t)
+	req := &logical.Request{Storage: storage, Secret: &logical.Secret{InternalData: map[string]interface{}{}}}
+	if _, err := b.(*backend).revokeCreds(context.Background(), req, nil); err == nil {
+		t.Fatal("expected a secret without an account to be refused")
+	}
+}
+
+func TestIssueCreds_limits(t *testing.T) {
+	b, storage := getTestBackend(t)
+	funding := randomAccount(t)
+	funding.TxSpendLimit = "10"
+	funding.ApprovalThreshold = "3"
+	putTestAccount(t, storage, "funding", funding)
+
+	request := func(operation logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+	}
+
+	// A role can't fund accounts with more than the funding account may send
+	if _, err := request(logical.UpdateOperation, "roles/temp", map[string]interface{}{"funding_account": "funding", "starting_balance": "11"}); err == nil {
+		t.Fatal("expected a starting balance above the spend limit of the funding account to be refused")
+	}
+
+	// Issued accounts can't wait for approval of their starting balance
+	if _, err := request(logical.UpdateOperation, "roles/temp", map[string]interface{}{"funding_account": "funding", "starting_balance": "5"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(logical.ReadOperation, "creds/temp", nil); errorCode(err) != 403 {
+		t.Fatalf("expected a starting balance above the approval threshold to be refused, got %v", err)
+	}
+
+	// The lease limit counts the accounts issued from the role, not those of roles with a longer name
+	if _, err := request(logical.UpdateOperation, "roles/temp", map[string]interface{}{"funding_account": "funding", "starting_balance": "2", "max_leases": 1}); err != nil {
+		t.Fatal(err)
+	}
+	other := randomAccount(t)
+	other.Role = "temp-long"
+	putTestAccount(t, storage, "creds-temp-long-1234abcd", other)
+	issued := randomAccount(t)
+	issued.Role = "temp"
+	putTestAccount(t, storage, "creds-temp-1234abcd", issued)
+
+	leases, err := b.(*backend).countLeases(context.Background(), &logical.Request{Storage: storage}, "temp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases != 1 {
+		t.Fatalf("expected 1 lease, got %d", leases)
+	}
+	if _, err := request(logical.ReadOperation, "creds/temp", nil); errorCode(err) != 403 {
+		t.Fatalf("expected the lease limit to be enforced, got %v", err)
+	}
+}
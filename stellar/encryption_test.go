@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The curve25519 key derived from the seed must match the one derived from the address
+func TestBoxKeys_match(t *testing.T) {
+	b := Backend()
+	storage := &logical.InmemStorage{}
+	account := randomAccount(t)
+
+	entry, err := logical.StorageEntryJSON("accounts/boxed", account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, _, err := b.accountBoxKey(context.Background(), &logical.Request{Storage: storage}, "boxed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := addressBoxKey(account.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(derived, publicKey[:]) {
+		t.Fatal("curve25519 keys derived from the seed and the address differ")
+	}
+}
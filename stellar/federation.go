@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/pkg/errors"
+	proto "github.com/stellar/go/protocols/federation"
+	"github.com/stellar/go/strkey"
+	"strings"
+	"time"
+)
+
+// federationResolver resolves federation addresses (name*domain) to accounts, per SEP-2. The federation client of
+// the Stellar SDK discovers the federation server of the domain through its stellar.toml.
+type federationResolver interface {
+	LookupByAddress(address string) (*proto.NameResponse, error)
+}
+
+// federationDestination is a resolved federation address
+type federationDestination struct {
+	AccountID string
+	MemoType  string // Memo the payment must carry, if any
+	Memo      string
+	expires   time.Time
+}
+
+// isFederationAddress returns whether the destination is a federation address rather than an account
+func isFederationAddress(address string) bool {
+	return strings.Contains(address, "*")
+}
+
+// resolveFederationAddress resolves a federation address, from the cache while it is recent enough
+func (b *backend) resolveFederationAddress(ctx context.Context, s logical.Storage, address string) (*federationDestination, error) {
+	b.federationCacheLock.Lock()
+	cached, ok := b.federationCache[address]
+	b.federationCacheLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.federation.LookupByAddress(address)
+	if err != nil {
+		return nil, logical.CodedError(400, errors.Wrap(err, "failed to resolve federation address "+address).Error())
+	}
+	if !strkey.IsValidEd25519PublicKey(resp.AccountID) {
+		return nil, logical.CodedError(400, fmt.Sprintf("federation address %s resolved to an invalid account: %s", address, resp.AccountID))
+	}
+
+	resolved := &federationDestination{
+		AccountID: resp.AccountID,
+		MemoType:  resp.MemoType,
+		Memo:      resp.Memo.Value,
+		expires:   time.Now().Add(time.Duration(config.FederationCacheTTL) * time.Second),
+	}
+	switch resolved.MemoType {
+	case "", "text", "id", "hash":
+	default:
+		return nil, logical.CodedError(400, fmt.Sprintf("federation address %s requires an unsupported memo type: %s", address, resolved.MemoType))
+	}
+
+	if config.FederationCacheTTL > 0 {
+		b.federationCacheLock.Lock()
+		b.federationCache[address] = resolved
+		b.federationCacheLock.Unlock()
+	}
+	return resolved, nil
+}
+
+// resolveAddresses replaces the federation addresses in the list with the accounts they resolve to
+func (b *backend) resolveAddresses(ctx context.Context, s logical.Storage, addresses []string) ([]string, error) {
+	var resolved []string
+	for _, address := range addresses {
+		if isFederationAddress(address) {
+			destination, err := b.resolveFederationAddress(ctx, s, address)
+			if err != nil {
+				return nil, err
+			}
+			address = destination.AccountID
+		}
+		resolved = append(resolved, address)
+	}
+	return resolved, nil
+}
+
+// applyFederationMemo sets the memo a federation address requires on the transaction, failing if the caller asked
+// for a different one
+func applyFederationMemo(opts *transactionOptions, destination *federationDestination) error {
+	if destination.MemoType == "" {
+		return nil
+	}
+	if opts.Memo != "" && (opts.Memo != destination.Memo || firstNonEmpty(opts.MemoType, "text") != destination.MemoType) {
+		return logical.CodedError(400, "memo conflicts with the memo required by the federation address")
+	}
+	opts.Memo = destination.Memo
+	opts.MemoType = destination.MemoType
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	proto "github.com/stellar/go/protocols/federation"
+)
+
+// staticFederation resolves the federation addresses it holds, counting the lookups
+type staticFederation struct {
+	names   map[string]*proto.NameResponse
+	lookups int
+}
+
+func (f *staticFederation) LookupByAddress(address string) (*proto.NameResponse, error) {
+	f.lookups++
+	if resp, ok := f.names[address]; ok {
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%s not found", address)
+}
+
+func TestResolveFederationAddress_cachedWithMemo(t *testing.T) {
+	account := randomAccount(t)
+	resolver := &staticFederation{names: map[string]*proto.NameResponse{
+		"alice*example.com": &proto.NameResponse{AccountID: account.Address, MemoType: "id", Memo: proto.Memo{Value: "4711"}},
+	}}
+
+	b := Backend()
+	b.federation = resolver
+	storage := &logical.InmemStorage{}
+	address := "alice*example.com"
+
+	for i := 0; i < 2; i++ {
+		destination, err := b.resolveFederationAddress(context.Background(), storage, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if destination.AccountID != account.Address {
+			t.Fatalf("expected %s, got %s", account.Address, destination.AccountID)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Fatalf("expected the second resolution to be cached, got %d lookups", resolver.lookups)
+	}
+
+	destination, _ := b.resolveFederationAddress(context.Background(), storage, address)
+	opts := &transactionOptions{}
+	if err := applyFederationMemo(opts, destination); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Memo != "4711" || opts.MemoType != "id" {
+		t.Fatalf("expected the federation memo to be applied, got %s %s", opts.MemoType, opts.Memo)
+	}
+
+	opts = &transactionOptions{Memo: "other"}
+	if err := applyFederationMemo(opts, destination); err == nil {
+		t.Fatal("expected a conflicting memo to be refused")
+	}
+
+	if _, err := b.resolveFederationAddress(context.Background(), storage, "bob*example.com"); err == nil {
+		t.Fatal("expected an unknown federation address to fail")
+	}
+}
+
+func TestFederationLookup(t *testing.T) {
+	b, storage := getTestBackend(t)
+	request := func(operation logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: operation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+	}
+
+	if _, err := request(logical.UpdateOperation, "config", map[string]interface{}{"federation_domain": "Example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	alice := storeTestAccount(t, storage, "alice")
+	storeTestAccount(t, storage, "bob")
+	if _, err := request(logical.UpdateOperation, "accounts/alice", map[string]interface{}{"federation_name": "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := request(logical.ReadOperation, "federation", map[string]interface{}{"q": "alice*example.com", "type": "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["account_id"] != alice.Address || resp.Data["stellar_address"] != "alice*example.com" {
+		t.Fatalf("unexpected name lookup result: %v", resp.Data)
+	}
+
+	resp, err = request(logical.ReadOperation, "federation", map[string]interface{}{"q": alice.Address, "type": "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["stellar_address"] != "alice*example.com" {
+		t.Fatalf("unexpected reverse lookup result: %v", resp.Data)
+	}
+
+	for _, q := range []string{"bob*example.com", "alice*other.com"} {
+		if _, err := request(logical.ReadOperation, "federation", map[string]interface{}{"q": q, "type": "name"}); err == nil {
+			t.Fatalf("expected %s not to be found", q)
+		}
+	}
+
+	// Names are unique across accounts
+	if _, err := request(logical.UpdateOperation, "accounts/bob", map[string]interface{}{"federation_name": "ALICE"}); err == nil {
+		t.Fatal("expected a name used by another account to be refused")
+	}
+
+	// Renaming frees the old name
+	if _, err := request(logical.UpdateOperation, "accounts/alice", map[string]interface{}{"federation_name": "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(logical.ReadOperation, "federation", map[string]interface{}{"q": "alice*example.com", "type": "name"}); err == nil {
+		t.Fatal("expected the old name to be released")
+	}
+	if _, err := request(logical.UpdateOperation, "accounts/bob", map[string]interface{}{"federation_name": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestChargeFeeBudget(t *testing.T) {
+	b := Backend()
+	storage := &logical.InmemStorage{}
+	req := &logical.Request{Storage: storage}
+	account := &Account{FeeBumpDailyBudget: 1000}
+
+	if err := b.chargeFeeBudget(context.Background(), req, "fees", account, 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.chargeFeeBudget(context.Background(), req, "fees", account, 400); err != nil {
+		t.Fatalf("expected the budget to be usable up to its limit, got %v", err)
+	}
+	if err := b.chargeFeeBudget(context.Background(), req, "fees", account, 1); errorCode(err) != 403 {
+		t.Fatalf("expected a fee above the budget to be refused, got %v", err)
+	}
+
+	// Budgets are per account
+	if err := b.chargeFeeBudget(context.Background(), req, "other", account, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// A budget spent on a previous day starts over
+	entry, err := logical.StorageEntryJSON("fee_budgets/fees", &FeeBudget{
+		Day:   time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02"),
+		Spent: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.chargeFeeBudget(context.Background(), req, "fees", account, 900); err != nil {
+		t.Fatalf("expected yesterday's spending not to count, got %v", err)
+	}
+	entry, err = storage.Get(context.Background(), "fee_budgets/fees")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var budget FeeBudget
+	if err := entry.DecodeJSON(&budget); err != nil {
+		t.Fatal(err)
+	}
+	if budget.Day != time.Now().UTC().Format("2006-01-02") || budget.Spent != 900 {
+		t.Fatalf("expected the budget to be reset to today, got %+v", budget)
+	}
+}
+
+func TestChargeFeeBudget_unlimited(t *testing.T) {
+	b := Backend()
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+
+	// Without a daily budget fees are only recorded
+	for i := 0; i < 3; i++ {
+		if err := b.chargeFeeBudget(context.Background(), req, "fees", &Account{}, 1000000); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
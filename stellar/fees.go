@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/pkg/errors"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+)
+
+// chooseBaseFee returns the base fee per operation to bid. A requested fee overrides the configured fee, but may not
+// exceed the configured cap, while a configured or dynamic fee is capped.
+func (b *backend) chooseBaseFee(config *Config, requested int64) (int64, error) {
+	if requested < 0 {
+		return 0, logical.CodedError(400, "max_fee must not be negative")
+	}
+	if requested > 0 {
+		if requested < txnbuild.MinBaseFee {
+			return 0, logical.CodedError(400, fmt.Sprintf("max_fee must be at least %d", txnbuild.MinBaseFee))
+		}
+		if config.MaxBaseFee > 0 && requested > config.MaxBaseFee {
+			return 0, logical.CodedError(403, fmt.Sprintf("max_fee (%d) is larger than the configured max_base_fee (%d)", requested, config.MaxBaseFee))
+		}
+		return requested, nil
+	}
+
+	fee := config.BaseFee
+	if config.FeeMode == feeModeDynamic {
+		stats, err := b.horizon.FeeStats()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to load fee stats")
+		}
+		fee = feeChargedPercentile(stats.FeeCharged, config.FeePercentile)
+		if stats.LastLedgerBaseFee > fee {
+			fee = stats.LastLedgerBaseFee
+		}
+	}
+
+	if fee < txnbuild.MinBaseFee {
+		fee = txnbuild.MinBaseFee
+	}
+	if config.MaxBaseFee > 0 && fee > config.MaxBaseFee {
+		fee = config.MaxBaseFee
+	}
+	return fee, nil
+}
+
+// feeChargedPercentile returns the given percentile of the distribution of recently charged fees
+func feeChargedPercentile(fees hProtocol.FeeDistribution, percentile int) int64 {
+	switch percentile {
+	case 10:
+		return fees.P10
+	case 20:
+		return fees.P20
+	case 30:
+		return fees.P30
+	case 40:
+		return fees.P40
+	case 60:
+		return fees.P60
+	case 70:
+		return fees.P70
+	case 80:
+		return fees.P80
+	case 90:
+		return fees.P90
+	case 95:
+		return fees.P95
+	case 99:
+		return fees.P99
+	default:
+		return fees.P50
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"testing"
+
+	"github.com/stellar/go/clients/horizonclient"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+)
+
+func TestChooseBaseFee_fixed(t *testing.T) {
+	b := Backend()
+
+	cases := []struct {
+		name      string
+		config    Config
+		requested int64
+		fee       int64
+		code      int
+	}{
+		{"default", Config{FeeMode: feeModeFixed}, 0, txnbuild.MinBaseFee, 0},
+		{"configured", Config{FeeMode: feeModeFixed, BaseFee: 500}, 0, 500, 0},
+		{"configured above cap", Config{FeeMode: feeModeFixed, BaseFee: 500, MaxBaseFee: 300}, 0, 300, 0},
+		{"requested", Config{FeeMode: feeModeFixed, BaseFee: 500}, 200, 200, 0},
+		{"requested within cap", Config{FeeMode: feeModeFixed, MaxBaseFee: 1000}, 1000, 1000, 0},
+		{"requested above cap", Config{FeeMode: feeModeFixed, MaxBaseFee: 1000}, 1001, 0, 403},
+		{"requested below minimum", Config{FeeMode: feeModeFixed}, txnbuild.MinBaseFee - 1, 0, 400},
+		{"negative", Config{FeeMode: feeModeFixed}, -1, 0, 400},
+	}
+	for _, c := range cases {
+		config := c.config
+		fee, err := b.chooseBaseFee(&config, c.requested)
+		if c.code != 0 {
+			if errorCode(err) != c.code {
+				t.Errorf("%s: expected a %d, got %v", c.name, c.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if fee != c.fee {
+			t.Errorf("%s: expected a fee of %d, got %d", c.name, c.fee, fee)
+		}
+	}
+}
+
+func TestChooseBaseFee_dynamic(t *testing.T) {
+	b := Backend()
+	client := &horizonclient.MockClient{}
+	client.On("FeeStats").Return(hProtocol.FeeStats{
+		LastLedgerBaseFee: 100,
+		FeeCharged:        hProtocol.FeeDistribution{P10: 100, P50: 300, P90: 900, P99: 5000},
+	}, nil)
+	b.horizon = client
+
+	cases := []struct {
+		name   string
+		config Config
+		fee    int64
+	}{
+		{"median", Config{FeeMode: feeModeDynamic, FeePercentile: 50}, 300},
+		{"percentile", Config{FeeMode: feeModeDynamic, FeePercentile: 90}, 900},
+		{"capped", Config{FeeMode: feeModeDynamic, FeePercentile: 99, MaxBaseFee: 2000}, 2000},
+		{"ignores the fixed fee", Config{FeeMode: feeModeDynamic, FeePercentile: 10, BaseFee: 700}, 100},
+	}
+	for _, c := range cases {
+		config := c.config
+		fee, err := b.chooseBaseFee(&config, 0)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if fee != c.fee {
+			t.Errorf("%s: expected a fee of %d, got %d", c.name, c.fee, fee)
+		}
+	}
+
+	// A requested fee is used without loading the fee stats
+	fee, err := b.chooseBaseFee(&Config{FeeMode: feeModeDynamic, FeePercentile: 50}, 150)
+	if err != nil || fee != 150 {
+		t.Fatalf("expected the requested fee, got %d %v", fee, err)
+	}
+	client.AssertNumberOfCalls(t, "FeeStats", len(cases))
+}
+
+func TestChooseBaseFee_lastLedgerBaseFee(t *testing.T) {
+	b := Backend()
+	client := &horizonclient.MockClient{}
+	client.On("FeeStats").Return(hProtocol.FeeStats{
+		LastLedgerBaseFee: 400,
+		FeeCharged:        hProtocol.FeeDistribution{P50: 100},
+	}, nil)
+	b.horizon = client
+
+	// A bid below the base fee of the last ledger would not be included while the network is surging
+	fee, err := b.chooseBaseFee(&Config{FeeMode: feeModeDynamic, FeePercentile: 50}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee != 400 {
+		t.Fatalf("expected the last ledger base fee, got %d", fee)
+	}
+}
+
+func TestFeeChargedPercentile(t *testing.T) {
+	fees := hProtocol.FeeDistribution{P10: 10, P20: 20, P30: 30, P40: 40, P50: 50, P60: 60, P70: 70, P80: 80, P90: 90, P95: 95, P99: 99}
+	for _, percentile := range []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 95, 99} {
+		if fee := feeChargedPercentile(fees, percentile); fee != int64(percentile) {
+			t.Errorf("expected percentile %d to be %d, got %d", percentile, percentile, fee)
+		}
+	}
+	if fee := feeChargedPercentile(fees, 55); fee != 50 {
+		t.Errorf("expected an unknown percentile to fall back to the median, got %d", fee)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"time"
+)
+
+// IdempotentResponse is the response of the first request made with an idempotency key
+type IdempotentResponse struct {
+	Fingerprint string                 `json:"fingerprint"` // Hash of the path and parameters of the request
+	Data        map[string]interface{} `json:"data"`
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+// idempotencyKeyField is the request field of the signing paths which makes retries safe
+func idempotencyKeyField() *framework.FieldSchema {
+	return &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "(Optional) Key identifying the request, repeats of which return the original response",
+	}
+}
+
+// idempotent wraps a signing callback so that repeating a request with the same idempotency_key and parameters
+// returns the original response instead of signing again, while reusing the key with other parameters fails.
+func (b *backend) idempotent(callback framework.OperationFunc) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		key, _ := req.Data["idempotency_key"].(string)
+		if key == "" {
+			return callback(ctx, req, d)
+		}
+
+		fingerprint, err := requestFingerprint(req)
+		if err != nil {
+			return nil, err
+		}
+		// Keys are scoped to the path and the requester, so that the same key used elsewhere is a different request
+		keyHash := sha256.Sum256([]byte(req.Path + "\x00" + requesterID(req) + "\x00" + key))
+		path := "idempotency/" + hex.EncodeToString(keyHash[:])
+
+		config, err := b.readConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+
+		// Claim the key, so that a retry arriving while the first request is still signing can't sign again
+		b.idempotencyLock.Lock()
+		if b.idempotencyInFlight[path] {
+			b.idempotencyLock.Unlock()
+			return nil, logical.CodedError(409, "a request with this idempotency_key is still in progress")
+		}
+		stored, err := b.readIdempotentResponse(ctx, req.Storage, path)
+		if err != nil {
+			b.idempotencyLock.Unlock()
+			return nil, err
+		}
+		if stored != nil && time.Since(stored.CreatedAt) < time.Duration(config.IdempotencyWindow)*time.Second {
+			b.idempotencyLock.Unlock()
+			if stored.Fingerprint != fingerprint {
+				return nil, logical.CodedError(409, "idempotency_key was already used with different parameters")
+			}
+			stored.Data["idempotent_replay"] = true
+			return &logical.Response{
+				Data: stored.Data,
+			}, nil
+		}
+		b.idempotencyInFlight[path] = true
+		b.idempotencyLock.Unlock()
+
+		defer func() {
+			b.idempotencyLock.Lock()
+			delete(b.idempotencyInFlight, path)
+			b.idempotencyLock.Unlock()
+		}()
+
+		resp, err := callback(ctx, req, d)
+		if err != nil || resp == nil || resp.IsError() {
+			return resp, err
+		}
+
+		// Round trip the response through JSON, so that the first response matches the replays
+		data, err := json.Marshal(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		stored = &IdempotentResponse{Fingerprint: fingerprint, CreatedAt: time.Now().UTC()}
+		if err := json.Unmarshal(data, &stored.Data); err != nil {
+			return nil, err
+		}
+		entry, err := logical.StorageEntryJSON(path, stored)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, fmt.Errorf("failed to store idempotent response: %s", err)
+		}
+
+		return resp, nil
+	}
+}
+
+// requesterID identifies who made a request: its entity, or the token accessor for tokens without an entity
+func requesterID(req *logical.Request) string {
+	if req.EntityID != "" {
+		return req.EntityID
+	}
+	if req.ClientTokenAccessor != "" {
+		return "accessor:" + req.ClientTokenAccessor
+	}
+	return ""
+}
+
+// requestFingerprint hashes the path and parameters of the request, other than the idempotency key
+func requestFingerprint(req *logical.Request) (string, error) {
+	params := make(map[string]interface{})
+	for key, value := range req.Data {
+		if key != "idempotency_key" {
+			params[key] = value
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"path":   req.Path,
+		"params": params,
+	})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (b *backend) readIdempotentResponse(ctx context.Context, s logical.Storage, path string) (*IdempotentResponse, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read idempotent response")
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var stored IdempotentResponse
+	if err := entry.DecodeJSON(&stored); err != nil {
+		return nil, fmt.Errorf("failed to deserialize idempotent response")
+	}
+	return &stored, nil
+}
+
+// pruneIdempotentResponses deletes the responses whose idempotency window has passed
+func (b *backend) pruneIdempotentResponses(ctx context.Context, s logical.Storage) error {
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.List(ctx, "idempotency/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		stored, err := b.readIdempotentResponse(ctx, s, "idempotency/"+key)
+		if err != nil {
+			return err
+		}
+		if stored != nil && time.Since(stored.CreatedAt) >= time.Duration(config.IdempotencyWindow)*time.Second {
+			if err := s.Delete(ctx, "idempotency/"+key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
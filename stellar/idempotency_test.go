@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// countingCallback returns a signing callback stub which counts its invocations
+func countingCallback(calls *int) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		*calls++
+		if req.Data["fail"] == true {
+			return nil, fmt.Errorf("signing failed")
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{"call": *calls},
+		}, nil
+	}
+}
+
+func TestIdempotent(t *testing.T) {
+	type request struct {
+		path     string
+		entityID string
+		data     map[string]interface{}
+	}
+	payment := func(data map[string]interface{}) request {
+		return request{"payments", "alice", data}
+	}
+
+	tests := []struct {
+		name     string
+		requests []request
+		calls    int   // Invocations of the callback after all requests
+		codes    []int // Error code of each request, 0 when it succeeds
+		replays  []bool
+	}{
+		{
+			"replay",
+			[]request{
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "10"}),
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "10"}),
+			},
+			1, []int{0, 0}, []bool{false, true},
+		},
+		{
+			"different parameters",
+			[]request{
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "10"}),
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "20"}),
+			},
+			1, []int{0, 409}, []bool{false, false},
+		},
+		{
+			"without key",
+			[]request{
+				payment(map[string]interface{}{"amount": "10"}),
+				payment(map[string]interface{}{"amount": "10"}),
+			},
+			2, []int{0, 0}, []bool{false, false},
+		},
+		{
+			"other path",
+			[]request{
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "10"}),
+				{"offers", "alice", map[string]interface{}{"idempotency_key": "k", "amount": "10"}},
+			},
+			2, []int{0, 0}, []bool{false, false},
+		},
+		{
+			"other requester",
+			[]request{
+				payment(map[string]interface{}{"idempotency_key": "k", "amount": "10"}),
+				{"payments", "bob", map[string]interface{}{"idempotency_key": "k", "amount": "10"}},
+			},
+			2, []int{0, 0}, []bool{false, false},
+		},
+		{
+			"failure not stored",
+			[]request{
+				payment(map[string]interface{}{"idempotency_key": "k", "fail": true}),
+				payment(map[string]interface{}{"idempotency_key": "k", "fail": true}),
+			},
+			2, []int{500, 500}, []bool{false, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, storage := getTestBackend(t)
+			calls := 0
+			handler := b.(*backend).idempotent(countingCallback(&calls))
+
+			for i, r := range test.requests {
+				resp, err := handler(context.Background(), &logical.Request{
+					Path:     r.path,
+					EntityID: r.entityID,
+					Data:     r.data,
+					Storage:  storage,
+				}, nil)
+
+				code := 0
+				if err != nil {
+					if code = errorCode(err); code == 0 {
+						code = 500
+					}
+				}
+				if code != test.codes[i] {
+					t.Fatalf("request %d: expected code %d, got %v", i, test.codes[i], err)
+				}
+				if err != nil {
+					continue
+				}
+				replay, _ := resp.Data["idempotent_replay"].(bool)
+				if replay != test.replays[i] {
+					t.Fatalf("request %d: expected replay %v, got %v", i, test.replays[i], replay)
+				}
+				if replay && fmt.Sprint(resp.Data["call"]) != "1" {
+					t.Fatalf("request %d: expected the first response, got %v", i, resp.Data)
+				}
+			}
+			if calls != test.calls {
+				t.Fatalf("expected %d calls, got %d", test.calls, calls)
+			}
+		})
+	}
+}
+
+func TestIdempotent_inFlight(t *testing.T) {
+	b, storage := getTestBackend(t)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := b.(*backend).idempotent(func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		close(started)
+		<-release
+		return &logical.Response{Data: map[string]interface{}{"signed": true}}, nil
+	})
+	request := func() *logical.Request {
+		return &logical.Request{
+			Path:     "payments",
+			EntityID: "alice",
+			Data:     map[string]interface{}{"idempotency_key": "k"},
+			Storage:  storage,
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := handler(context.Background(), request(), nil)
+		done <- err
+	}()
+	<-started
+
+	if _, err := handler(context.Background(), request(), nil); errorCode(err) != 409 {
+		t.Fatalf("expected a retry while the first request is signing to be refused, got %v", err)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	resp, err := handler(context.Background(), request(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["idempotent_replay"] != true {
+		t.Fatalf("expected the stored response once the first request finished, got %v", resp.Data)
+	}
+}
+
+func TestPruneIdempotentResponses(t *testing.T) {
+	b, storage := getTestBackend(t)
+	ctx := context.Background()
+
+	for key, age := range map[string]time.Duration{"old": 25 * time.Hour, "recent": time.Hour} {
+		entry, err := logical.StorageEntryJSON("idempotency/"+key, &IdempotentResponse{CreatedAt: time.Now().Add(-age)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Put(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.(*backend).pruneIdempotentResponses(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.List(ctx, "idempotency/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "recent" {
+		t.Fatalf("expected only the response within the idempotency window to be kept, got %v", keys)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestLiquidityPools_requestValidation(t *testing.T) {
+	b, storage := getTestBackend(t)
+	account := randomAccount(t)
+	account.TxSpendLimit = "100"
+	usd := "USD:" + randomAccount(t).Address
+	eur := "EUR:" + randomAccount(t).Address
+	account.AllowedAssets = []string{"native", usd}
+	putTestAccount(t, storage, "lp", account)
+
+	deposit := func(data map[string]interface{}) map[string]interface{} {
+		fields := map[string]interface{}{"maxAmountA": "10", "maxAmountB": "10", "minPrice": "1", "maxPrice": "2"}
+		for key, value := range data {
+			fields[key] = value
+		}
+		return fields
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		data     map[string]interface{}
+		expected string
+	}{
+		{"missing asset", "accounts/lp/liquidity_pools/trust", map[string]interface{}{"assetA": "native"}, "assetB"},
+		{"unsorted pair", "accounts/lp/liquidity_pools/trust", map[string]interface{}{"assetA": usd, "assetB": "native"}, "must sort before"},
+		{"unknown account", "accounts/nobody/liquidity_pools/trust", map[string]interface{}{"assetA": "native", "assetB": usd}, "account not found"},
+		{"disallowed asset", "accounts/lp/liquidity_pools/trust", map[string]interface{}{"assetA": "native", "assetB": eur}, "not an allowed asset"},
+		{"unknown field", "accounts/lp/liquidity_pools/trust", map[string]interface{}{"assetA": "native", "assetB": usd, "amount": "1"}, "unknown fields"},
+		{"zero deposit", "accounts/lp/liquidity_pools/deposit", deposit(map[string]interface{}{"assetA": "native", "assetB": usd, "maxAmountA": "0"}), "maxAmountA must be a positive number"},
+		{"inverted prices", "accounts/lp/liquidity_pools/deposit", deposit(map[string]interface{}{"assetA": "native", "assetB": usd, "minPrice": "3"}), "minPrice must not be larger than maxPrice"},
+		{"negative withdrawal", "accounts/lp/liquidity_pools/withdraw", map[string]interface{}{"assetA": "native", "assetB": usd, "amount": "-1", "minAmountA": "0", "minAmountB": "0"}, "amount is either not a number or is negative"},
+	}
+	for _, c := range cases {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      c.path,
+			Data:      c.data,
+			Storage:   storage,
+		})
+		if err == nil && resp != nil && resp.IsError() {
+			err = resp.Error()
+		}
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestLiquidityPools_depositWithinSpendLimit(t *testing.T) {
+	b, storage := getTestBackend(t)
+	account := randomAccount(t)
+	account.TxSpendLimit = "100"
+	putTestAccount(t, storage, "lp", account)
+	usd := "USD:" + randomAccount(t).Address
+
+	// Each deposited amount leaves the account, so each is checked against the spend limit on its own
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/lp/liquidity_pools/deposit",
+		Data: map[string]interface{}{
+			"assetA": "native", "assetB": usd, "maxAmountA": "60", "maxAmountB": "100.0000001", "minPrice": "1", "maxPrice": "2",
+		},
+		Storage: storage,
+	})
+	if err == nil || !strings.Contains(err.Error(), "larger than the transactional limit") {
+		t.Fatalf("expected the deposit to exceed the spend limit, got %v", err)
+	}
+}
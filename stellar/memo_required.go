@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	"net/http"
+	"time"
+)
+
+// Data entry with which accounts require incoming payments to carry a memo, per SEP-29
+const memoRequiredDataKey = "config.memo_required"
+
+// How long the memo requirement of a destination is cached for
+const memoRequiredCacheTTL = 5 * time.Minute
+
+type memoRequirement struct {
+	required bool
+	loadedAt time.Time
+}
+
+// memoRequired returns whether payments to the account must carry a memo, from the cache if it is recent enough.
+// Accounts which don't exist yet have no requirement.
+func (b *backend) memoRequired(address string) (bool, error) {
+	b.memoRequiredCacheLock.RLock()
+	cached, ok := b.memoRequiredCache[address]
+	b.memoRequiredCacheLock.RUnlock()
+	if ok && time.Since(cached.loadedAt) < memoRequiredCacheTTL {
+		return cached.required, nil
+	}
+
+	required := false
+	account, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: address})
+	if herr, ok := err.(*horizonclient.Error); !ok || herr.Problem.Status != http.StatusNotFound {
+		if err != nil {
+			return false, errors.Wrap(err, "failed to load data entries of "+address)
+		}
+		// Data entry values are base64 encoded, "MQ==" is "1"
+		required = account.Data[memoRequiredDataKey] == "MQ=="
+	}
+
+	b.memoRequiredCacheLock.Lock()
+	b.memoRequiredCache[address] = &memoRequirement{required: required, loadedAt: time.Now()}
+	b.memoRequiredCacheLock.Unlock()
+
+	return required, nil
+}
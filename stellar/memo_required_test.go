@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/clients/horizonclient"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/support/render/problem"
+)
+
+func TestMemoRequired(t *testing.T) {
+	tests := []struct {
+		name     string
+		account  hProtocol.Account
+		err      error
+		required bool
+		fails    bool
+	}{
+		{"required", hProtocol.Account{Data: map[string]string{memoRequiredDataKey: "MQ=="}}, nil, true, false},
+		{"zero", hProtocol.Account{Data: map[string]string{memoRequiredDataKey: "MA=="}}, nil, false, false},
+		{"not base64", hProtocol.Account{Data: map[string]string{memoRequiredDataKey: "1"}}, nil, false, false},
+		{"no data entry", hProtocol.Account{Data: map[string]string{"other": "MQ=="}}, nil, false, false},
+		{"not found", hProtocol.Account{}, &horizonclient.Error{Problem: problem.P{Status: 404}}, false, false},
+		{"unavailable", hProtocol.Account{}, &horizonclient.Error{Problem: problem.P{Status: 503}}, false, true},
+		{"network error", hProtocol.Account{}, errors.New("connection refused"), false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := getTestBackend(t)
+			address := randomAccount(t).Address
+			client := &horizonclient.MockClient{}
+			client.On("AccountDetail", horizonclient.AccountRequest{AccountID: address}).Return(test.account, test.err)
+			b.(*backend).horizon = client
+
+			required, err := b.(*backend).memoRequired(address)
+			if test.fails {
+				if err == nil {
+					t.Fatal("expected the lookup to fail")
+				}
+				if _, cached := b.(*backend).memoRequiredCache[address]; cached {
+					t.Fatal("expected a failed lookup not to be cached")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if required != test.required {
+				t.Fatalf("expected required to be %v", test.required)
+			}
+		})
+	}
+}
+
+func TestMemoRequired_cache(t *testing.T) {
+	b, _ := getTestBackend(t)
+	address := randomAccount(t).Address
+	client := &horizonclient.MockClient{}
+	client.On("AccountDetail", horizonclient.AccountRequest{AccountID: address}).
+		Return(hProtocol.Account{Data: map[string]string{memoRequiredDataKey: "MQ=="}}, nil)
+	b.(*backend).horizon = client
+
+	for i := 0; i < 3; i++ {
+		if required, err := b.(*backend).memoRequired(address); err != nil || !required {
+			t.Fatalf("expected a memo to be required, got %v %v", required, err)
+		}
+	}
+	client.AssertNumberOfCalls(t, "AccountDetail", 1)
+
+	// Once the cached requirement is too old it is loaded again
+	b.(*backend).memoRequiredCache[address].loadedAt = time.Now().Add(-memoRequiredCacheTTL)
+	if _, err := b.(*backend).memoRequired(address); err != nil {
+		t.Fatal(err)
+	}
+	client.AssertNumberOfCalls(t, "AccountDetail", 2)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stellar/go/keypair"
+)
+
+// Test vector of SEP-53
+const (
+	sep53Seed      = "SAKICEVQLYWGSOJS4WW7HZJWAHZVEEBS527LHK5V4MLJALYKICQCJXMW"
+	sep53Address   = "GBXFXNDLV4LSWA4VB7YIL5GBD7BVNR22SGBTDKMO2SBZZHDXSKZYCP7L"
+	sep53Message   = "Hello, World!"
+	sep53Signature = "fO5dbYhXUhBMhe6kId/cuVq/AfEnHRHEvsP8vXh03M1uLpi5e46yO2Q8rEBzu3feXQewcQE5GArp88u6ePK6BA=="
+)
+
+func TestSignMessage_sep53Vector(t *testing.T) {
+	b, storage := getTestBackend(t)
+	putTestAccount(t, storage, "signer", &Account{Address: sep53Address, Seed: sep53Seed, AccountId: sep53Address})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/signer/sign_message",
+		Data:      map[string]interface{}{"message": sep53Message},
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["signature"] != sep53Signature {
+		t.Fatalf("expected the SEP-53 signature, got %v", resp.Data["signature"])
+	}
+
+	// The binary encoding of the same message signs the same bytes
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/signer/sign_message",
+		Data:      map[string]interface{}{"message": base64.StdEncoding.EncodeToString([]byte(sep53Message)), "encoding": "base64"},
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["signature"] != sep53Signature {
+		t.Fatalf("expected the SEP-53 signature of the decoded message, got %v", resp.Data["signature"])
+	}
+	if resp.Data["audit_id"] == "" {
+		t.Fatal("expected the signature to be audited")
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	b, storage := getTestBackend(t)
+	signer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestAccount(t, storage, "signer", &Account{Address: signer.Address(), Seed: signer.Seed(), AccountId: signer.Address()})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "accounts/signer/sign_message",
+		Data:      map[string]interface{}{"message": "round trip"},
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := resp.Data["signature"].(string)
+
+	tests := []struct {
+		name      string
+		address   string
+		message   string
+		signature string
+		valid     bool
+	}{
+		{"round trip", signer.Address(), "round trip", signature, true},
+		{"SEP-53 vector", sep53Address, sep53Message, sep53Signature, true},
+		{"other message", signer.Address(), "round trip!", signature, false},
+		{"other address", sep53Address, "round trip", signature, false},
+		{"unprefixed signature", sep53Address, sep53Message, base64.StdEncoding.EncodeToString(mustSign(t, sep53Seed, sep53Message)), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "verify",
+				Data:      map[string]interface{}{"address": test.address, "message": test.message, "signature": test.signature},
+				Storage:   storage,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Data["valid"] != test.valid {
+				t.Fatalf("expected valid to be %v, got %v", test.valid, resp.Data["valid"])
+			}
+		})
+	}
+}
+
+// mustSign signs the raw message, without the SEP-53 prefix and hash
+func mustSign(t *testing.T, seed string, message string) []byte {
+	kp, err := keypair.ParseFull(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := kp.Sign([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// Test vectors of SEP-23
+const (
+	sep23Account   = "GA7QYNF7SOWQ3GLR2BGMZEHXAVIRZA4KVWLTJJFC7MGXUA74P7UJVSGZ"
+	sep23Muxed0    = "MA7QYNF7SOWQ3GLR2BGMZEHXAVIRZA4KVWLTJJFC7MGXUA74P7UJUAAAAAAAAAAAACJUQ"
+	sep23MuxedHigh = "MA7QYNF7SOWQ3GLR2BGMZEHXAVIRZA4KVWLTJJFC7MGXUA74P7UJVAAAAAAAAAAAAAJLK"
+)
+
+func TestMuxedAddress(t *testing.T) {
+	for id, expected := range map[uint64]string{0: sep23Muxed0, 1 << 63: sep23MuxedHigh} {
+		address, err := muxedAddress(sep23Account, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != expected {
+			t.Fatalf("expected %s for id %d, got %s", expected, id, address)
+		}
+	}
+	if _, err := muxedAddress("not an address", 1); err == nil {
+		t.Fatal("expected an invalid account address to be refused")
+	}
+}
+
+func TestBaseAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		muxed   bool
+		base    string
+	}{
+		{sep23Muxed0, true, sep23Account},
+		{sep23MuxedHigh, true, sep23Account},
+		{sep23Account, false, sep23Account},
+		{"alice*example.com", false, "alice*example.com"},
+		{sep23Muxed0[:len(sep23Muxed0)-1] + "A", false, sep23Muxed0[:len(sep23Muxed0)-1] + "A"},
+	}
+	for _, test := range tests {
+		if isMuxedAddress(test.address) != test.muxed {
+			t.Fatalf("expected %s to be muxed: %v", test.address, test.muxed)
+		}
+		if base := baseAddress(test.address); base != test.base {
+			t.Fatalf("expected the base address of %s to be %s, got %s", test.address, test.base, base)
+		}
+	}
+}
+
+func TestAddressListed(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		address string
+		listed  bool
+	}{
+		{"account covers its muxed addresses", []string{sep23Account}, sep23Muxed0, true},
+		{"account", []string{sep23Account}, sep23Account, true},
+		{"muxed address", []string{sep23Muxed0}, sep23Muxed0, true},
+		{"muxed address doesn't cover the account", []string{sep23Muxed0}, sep23Account, false},
+		{"muxed address doesn't cover other ids", []string{sep23Muxed0}, sep23MuxedHigh, false},
+		{"empty list", nil, sep23Muxed0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if addressListed(test.list, test.address) != test.listed {
+				t.Fatalf("expected listed to be %v", test.listed)
+			}
+		})
+	}
+}
+
+func TestDecodeAddress(t *testing.T) {
+	b, storage := getTestBackend(t)
+	putTestAccount(t, storage, "sep23", &Account{Address: sep23Account, AccountId: sep23Account})
+
+	request := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+	}
+
+	resp, err := request("accounts/sep23/muxed", map[string]interface{}{"id": "9223372036854775808"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["muxed_address"] != sep23MuxedHigh {
+		t.Fatalf("expected %s, got %v", sep23MuxedHigh, resp.Data["muxed_address"])
+	}
+	if _, err := request("accounts/sep23/muxed", map[string]interface{}{"id": "-1"}); errorCode(err) != 400 {
+		t.Fatalf("expected a negative id to be refused, got %v", err)
+	}
+
+	resp, err = request("addresses/decode", map[string]interface{}{"address": sep23MuxedHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["type"] != "muxed_account" || resp.Data["account_id"] != sep23Account || resp.Data["id"] != "9223372036854775808" {
+		t.Fatalf("unexpected decoded address %v", resp.Data)
+	}
+	resp, err = request("addresses/decode", map[string]interface{}{"address": sep23Account})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["type"] != "account" {
+		t.Fatalf("unexpected decoded address %v", resp.Data)
+	}
+	if _, err := request("addresses/decode", map[string]interface{}{"address": "SAKICEVQLYWGSOJS4WW7HZJWAHZVEEBS527LHK5V4MLJALYKICQCJXMW"}); errorCode(err) != 400 {
+		t.Fatalf("expected a seed to be refused, got %v", err)
+	}
+}
@@ -21,11 +21,14 @@ import (
 	"fmt"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
 )
 
 // Account is a Stellar account
@@ -36,6 +39,38 @@ type Account struct {
 	TxSpendLimit string   `json:"tx_spend_limit"`
 	Whitelist    []string `json:"whitelist"`
 	Blacklist    []string `json:"blacklist"`
+
+	// Assets this account may transact in (native or CODE:ISSUER), empty allows all
+	AllowedAssets []string `json:"allowed_assets"`
+
+	// DEX offer policy
+	OfferAssetPairs      []string          `json:"offer_asset_pairs"`      // Allowed SELLING/BUYING pairs, empty allows all
+	MaxOfferAmount       string            `json:"max_offer_amount"`       // Maximum amount of the selling asset in one offer
+	OfferPriceBand       string            `json:"offer_price_band"`       // Maximum deviation from the reference price, in percent
+	OfferReferencePrices map[string]string `json:"offer_reference_prices"` // Reference prices keyed by SELLING/BUYING pair
+
+	// Payments above the approval threshold need a quorum of distinct approvers before they are signed
+	ApprovalThreshold string `json:"approval_threshold"`
+	ApprovalQuorum    int    `json:"approval_quorum"`
+	ApprovalTTL       int    `json:"approval_ttl"` // Seconds before a pending approval expires
+
+	// Limits on the fees this account pays when sponsoring fee bump transactions, in stroops (0 is unlimited)
+	FeeBumpMaxFee      int64 `json:"fee_bump_max_fee"`
+	FeeBumpDailyBudget int64 `json:"fee_bump_daily_budget"`
+
+	// Maximum number of ledger entries this account may sponsor the reserves of (0 is unlimited)
+	SponsorshipLimit int `json:"sponsorship_limit"`
+
+	// Role the account was created from, and free form metadata
+	Role     string            `json:"role"`
+	Metadata map[string]string `json:"metadata"`
+
+	// Wallet the keys were derived from, at m/44'/148'/<wallet_index>'
+	Wallet      string `json:"wallet"`
+	WalletIndex uint32 `json:"wallet_index"`
+
+	// Name the account is found by in federation queries, as <federation_name>*<federation_domain>
+	FederationName string `json:"federation_name"`
 }
 
 func accountsPaths(b *backend) []*framework.Path {
@@ -66,11 +101,84 @@ func accountsPaths(b *backend) []*framework.Path {
 				},
 				"whitelist": &framework.FieldSchema{
 					Type:        framework.TypeCommaStringSlice,
-					Description: "(Optional) The list of accounts that this account can transact with.",
+					Description: "(Optional) The list of accounts (or federation addresses) that this account can transact with.",
 				},
 				"blacklist": &framework.FieldSchema{
 					Type:        framework.TypeCommaStringSlice,
-					Description: "(Optional) The list of accounts that this account is forbidden from transacting with.",
+					Description: "(Optional) The list of accounts (or federation addresses) that this account is forbidden from transacting with.",
+				},
+				"allowed_assets": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of assets (native or CODE:ISSUER) this account may transact in.",
+				},
+				"offer_asset_pairs": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of SELLING/BUYING asset pairs this account may place offers for, e.g. native/USD:G...",
+				},
+				"max_offer_amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum amount of the selling asset in a single offer",
+					Default:     "0",
+				},
+				"offer_price_band": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum deviation of an offer price from the reference price, in percent",
+					Default:     "0",
+				},
+				"offer_reference_prices": &framework.FieldSchema{
+					Type:        framework.TypeKVPairs,
+					Description: "(Optional) Reference prices keyed by SELLING/BUYING asset pair, used when no reference price is supplied",
+				},
+				"approval_threshold": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Payments larger than this amount need approval before they are signed",
+					Default:     "0",
+				},
+				"approval_quorum": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Number of distinct approvers a payment above the approval threshold needs",
+					Default:     1,
+				},
+				"approval_ttl": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) How long a payment can wait for approval before it expires",
+					Default:     86400,
+				},
+				"fee_bump_max_fee": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum fee, in stroops, this account pays for a single fee bump transaction",
+				},
+				"fee_bump_daily_budget": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum total fees, in stroops, this account pays for fee bump transactions per day",
+				},
+				"sponsor_account_name": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Account which creates the new account and sponsors its reserve, funding xlm_balance",
+				},
+				"sponsorship_limit": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum number of ledger entries this account may sponsor the reserves of",
+				},
+				"role": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Role whose template provides the fields not given in the request",
+				},
+				"metadata": &framework.FieldSchema{
+					Type:        framework.TypeKVPairs,
+					Description: "(Optional) Free form key/value metadata, added to the metadata of the role",
+				},
+				"wallet": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Wallet the keys of a new account are derived from, instead of being random",
+				},
+				"federation_name": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Name the account is found by in federation queries, empty removes it",
+				},
+				"wallet_index": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Index the keys are derived at, defaults to the next unused index of the wallet",
 				},
 			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -100,49 +208,287 @@ func (b *backend) pathCreateAccount(ctx context.Context, req *logical.Request, d
 	//	return nil, logical.CodedError(422, err.Error())
 	//}
 
+	// Updating an existing account keeps its keys and the policies not given in the request
+	existing, err := b.readVaultAccount(ctx, req, req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A role provides the fields not given in the request. Updates keep the role the account was created from.
+	role := &Role{}
+	roleName := d.Get("role").(string)
+	_, roleChanged := d.GetOk("role")
+	if roleName == "" && existing != nil {
+		roleName = existing.Role
+	}
+	if roleName != "" {
+		storedRole, err := b.readStoredRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if storedRole == nil {
+			return nil, logical.CodedError(400, "role not found: "+roleName)
+		}
+		role = storedRole
+	}
+
 	// Read optional fields
-	var whitelist []string
+	whitelist := role.Whitelist
 	if whitelistRaw, ok := d.GetOk("whitelist"); ok {
 		whitelist = whitelistRaw.([]string)
 	}
-	var blacklist []string
+	blacklist := role.Blacklist
 	if blacklistRaw, ok := d.GetOk("blacklist"); ok {
 		blacklist = blacklistRaw.([]string)
 	}
 
+	// Federation addresses in the lists are stored as the accounts they resolve to
+	whitelist, err = b.resolveAddresses(ctx, req.Storage, whitelist)
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err = b.resolveAddresses(ctx, req.Storage, blacklist)
+	if err != nil {
+		return nil, err
+	}
+
 	txSpendLimitString := d.Get("tx_spend_limit").(string)
+	if _, ok := d.GetOk("tx_spend_limit"); !ok && role.TxSpendLimit != "" {
+		txSpendLimitString = role.TxSpendLimit
+	}
 	txSpendLimit, err := decimal.NewFromString(txSpendLimitString)
 	if err != nil || txSpendLimit.IsNegative() {
 		return nil, fmt.Errorf("tx_spend_limit is either not a number or is negative")
 	}
 
-	// Generate a random KeyPair
-	random, err := keypair.Random()
-	if err != nil {
-		log.Fatal(err)
+	allowedAssets := role.AllowedAssets
+	if allowedAssetsRaw, ok := d.GetOk("allowed_assets"); ok {
+		allowedAssets = allowedAssetsRaw.([]string)
+	}
+	for _, allowedAsset := range allowedAssets {
+		if _, err := parseAssetString(allowedAsset); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
 	}
 
-	// Get the public key and seed
-	address := random.Address()
-	seed := random.Seed()
+	// Read the optional offer policy fields
+	var offerAssetPairs []string
+	if offerAssetPairsRaw, ok := d.GetOk("offer_asset_pairs"); ok {
+		offerAssetPairs = offerAssetPairsRaw.([]string)
+	}
+	maxOfferAmount, err := decimal.NewFromString(d.Get("max_offer_amount").(string))
+	if err != nil || maxOfferAmount.IsNegative() {
+		return nil, fmt.Errorf("max_offer_amount is either not a number or is negative")
+	}
+	offerPriceBand, err := decimal.NewFromString(d.Get("offer_price_band").(string))
+	if err != nil || offerPriceBand.IsNegative() {
+		return nil, fmt.Errorf("offer_price_band is either not a number or is negative")
+	}
+	var offerReferencePrices map[string]string
+	if offerReferencePricesRaw, ok := d.GetOk("offer_reference_prices"); ok {
+		offerReferencePrices = offerReferencePricesRaw.(map[string]string)
+	}
 
-	// Prod anchor
-	//err = fundAccount(address)
+	// Read the optional approval policy fields
+	approvalThreshold, err := decimal.NewFromString(d.Get("approval_threshold").(string))
+	if err != nil || approvalThreshold.IsNegative() {
+		return nil, fmt.Errorf("approval_threshold is either not a number or is negative")
+	}
+	approvalQuorum := d.Get("approval_quorum").(int)
+	if approvalQuorum < 1 {
+		return nil, fmt.Errorf("approval_quorum must be at least 1")
+	}
+	approvalTTL := d.Get("approval_ttl").(int)
+	if approvalTTL <= 0 {
+		return nil, fmt.Errorf("approval_ttl must be positive")
+	}
 
-	// Testnet
-	err = fundTestAccount(address)
-	if err != nil {
-		log.Fatal(err)
+	// Read the optional fee bump policy fields
+	feeBumpMaxFee := d.Get("fee_bump_max_fee").(int)
+	if feeBumpMaxFee < 0 {
+		return nil, fmt.Errorf("fee_bump_max_fee must not be negative")
+	}
+	feeBumpDailyBudget := d.Get("fee_bump_daily_budget").(int)
+	if feeBumpDailyBudget < 0 {
+		return nil, fmt.Errorf("fee_bump_daily_budget must not be negative")
+	}
+
+	sponsorshipLimit := d.Get("sponsorship_limit").(int)
+	if sponsorshipLimit < 0 {
+		return nil, fmt.Errorf("sponsorship_limit must not be negative")
+	}
+
+	// keep returns whether an update leaves the policy field unchanged, which it does unless the field is given in
+	// the request or, for fields a role provides, the role is changed
+	keep := func(field string, fromRole bool) bool {
+		if existing == nil {
+			return false
+		}
+		if _, ok := d.GetOk(field); ok {
+			return false
+		}
+		return !fromRole || !roleChanged
+	}
+
+	metadata := make(map[string]string)
+	baseMetadata := role.Metadata
+	if existing != nil && !roleChanged {
+		baseMetadata = existing.Metadata
 	}
+	for key, value := range baseMetadata {
+		metadata[key] = value
+	}
+	if metadataRaw, ok := d.GetOk("metadata"); ok {
+		for key, value := range metadataRaw.(map[string]string) {
+			metadata[key] = value
+		}
+	}
+
+	// Updating an existing account keeps its keys, otherwise we create a new one
+	accountJSON := existing
+	var fundingApproval *logical.Response
+	if accountJSON == nil {
+		// Derive the KeyPair from a wallet, or generate a random one
+		var random *keypair.Full
+		var walletIndex uint32
+		walletName := d.Get("wallet").(string)
+		if walletName != "" {
+			index := -1
+			if indexRaw, ok := d.GetOk("wallet_index"); ok {
+				if index = indexRaw.(int); index < 0 {
+					return nil, logical.CodedError(400, "wallet_index must not be negative")
+				}
+			}
+			random, walletIndex, err = b.deriveWalletAccount(ctx, req.Storage, walletName, index, strings.TrimPrefix(req.Path, "accounts/"))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			random, err = keypair.Random()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		// Get the public key and seed
+		address := random.Address()
+		seed := random.Seed()
+
+		if sponsorName := d.Get("sponsor_account_name").(string); sponsorName != "" {
+			// Create the account with its reserve paid by the sponsor
+			sponsor, err := b.readVaultAccount(ctx, req, "accounts/"+sponsorName)
+			if err != nil {
+				return nil, err
+			}
+			if sponsor == nil {
+				return nil, logical.CodedError(400, "sponsor account not found")
+			}
+
+			startingBalance := decimal.Zero
+			if xlmBalance := d.Get("xlm_balance").(string); xlmBalance != "" {
+				startingBalance, err = decimal.NewFromString(xlmBalance)
+				if err != nil || startingBalance.IsNegative() {
+					return nil, fmt.Errorf("xlm_balance is either not a number or is negative")
+				}
+			}
+
+			if _, err := b.createSponsoredAccount(ctx, req, sponsorName, sponsor, random, startingBalance); err != nil {
+				return nil, err
+			}
+		} else if fundingName := firstNonEmpty(d.Get("source_account_name").(string), role.FundingAccount); fundingName != "" {
+			// Create the account from a funding account
+			funding, err := b.readVaultAccount(ctx, req, "accounts/"+fundingName)
+			if err != nil {
+				return nil, err
+			}
+			if funding == nil {
+				return nil, logical.CodedError(400, "funding account not found: "+fundingName)
+			}
+
+			startingBalance, err := decimal.NewFromString(firstNonEmpty(d.Get("xlm_balance").(string), role.StartingBalance))
+			if err != nil || !startingBalance.IsPositive() {
+				return nil, fmt.Errorf("xlm_balance is either not a number or is not positive")
+			}
 
-	// Create and store an Account object in Vault
-	accountJSON := &Account{Address: address,
-		Seed:         seed,
-		AccountId:    address,
-		TxSpendLimit: txSpendLimit.String(),
-		Whitelist:    whitelist,
-		Blacklist:    blacklist}
+			// Flags can only be set once the account exists, which it doesn't while the funding waits for approval
+			if len(role.Flags) > 0 && requiresApproval(funding, startingBalance) {
+				return nil, logical.CodedError(403, "accounts with flags can't be funded above the approval_threshold of "+fundingName)
+			}
+			fundingApproval, err = b.fundAccount(ctx, req, fundingName, funding, address, startingBalance)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// Testnet
+			err = fundTestAccount(address)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		accountJSON = &Account{Address: address,
+			Seed:        seed,
+			AccountId:   address,
+			Wallet:      walletName,
+			WalletIndex: walletIndex}
+
+		if err := b.setAccountFlags(ctx, req, accountJSON, role.Flags); err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the account constraints
+	if !keep("tx_spend_limit", true) {
+		accountJSON.TxSpendLimit = txSpendLimit.String()
+	}
+	if !keep("whitelist", true) {
+		accountJSON.Whitelist = whitelist
+	}
+	if !keep("blacklist", true) {
+		accountJSON.Blacklist = blacklist
+	}
+	if !keep("allowed_assets", true) {
+		accountJSON.AllowedAssets = allowedAssets
+	}
+	if !keep("offer_asset_pairs", false) {
+		accountJSON.OfferAssetPairs = offerAssetPairs
+	}
+	if !keep("max_offer_amount", false) {
+		accountJSON.MaxOfferAmount = maxOfferAmount.String()
+	}
+	if !keep("offer_price_band", false) {
+		accountJSON.OfferPriceBand = offerPriceBand.String()
+	}
+	if !keep("offer_reference_prices", false) {
+		accountJSON.OfferReferencePrices = offerReferencePrices
+	}
+	if !keep("approval_threshold", false) {
+		accountJSON.ApprovalThreshold = approvalThreshold.String()
+	}
+	if !keep("approval_quorum", false) {
+		accountJSON.ApprovalQuorum = approvalQuorum
+	}
+	if !keep("approval_ttl", false) {
+		accountJSON.ApprovalTTL = approvalTTL
+	}
+	if !keep("fee_bump_max_fee", false) {
+		accountJSON.FeeBumpMaxFee = int64(feeBumpMaxFee)
+	}
+	if !keep("fee_bump_daily_budget", false) {
+		accountJSON.FeeBumpDailyBudget = int64(feeBumpDailyBudget)
+	}
+	if !keep("sponsorship_limit", false) {
+		accountJSON.SponsorshipLimit = sponsorshipLimit
+	}
+	accountJSON.Role = roleName
+	accountJSON.Metadata = metadata
+	if federationNameRaw, ok := d.GetOk("federation_name"); ok {
+		if err := b.setFederationName(ctx, req, strings.TrimPrefix(req.Path, "accounts/"), accountJSON, federationNameRaw.(string)); err != nil {
+			return nil, err
+		}
+	}
 
+	// Store the Account object in Vault
 	entry, err := logical.StorageEntryJSON(req.Path, accountJSON)
 	if err != nil {
 		return nil, err
@@ -153,17 +499,15 @@ func (b *backend) pathCreateAccount(ctx context.Context, req *logical.Request, d
 		return nil, err
 	}
 
-	log.Printf("successfully created account %v", address)
+	log.Printf("successfully stored account %v", accountJSON.Address)
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"address":          address,
-			"stellarAccountId": address,
-			"txSpendLimit":     txSpendLimit.String(),
-			"whitelist":        whitelist,
-			"blacklist":        blacklist,
-		},
-	}, nil
+	resp := &logical.Response{
+		Data: accountResponseData(accountJSON),
+	}
+	if fundingApproval != nil {
+		resp.Data["fundingApproval"] = fundingApproval.Data
+	}
+	return resp, nil
 }
 
 // Returns account details for the given account
@@ -178,23 +522,38 @@ func (b *backend) pathReadAccount(ctx context.Context, req *logical.Request, d *
 		return nil, nil
 	}
 
-	address := &vaultAccount.Address
-	whitelist := &vaultAccount.Whitelist
-	blacklist := &vaultAccount.Blacklist
-	accountId := &vaultAccount.AccountId
-	txSpendLimit := &vaultAccount.TxSpendLimit
-
 	return &logical.Response{
-		Data: map[string]interface{}{
-			"address":          address,
-			"stellarAccountId": accountId,
-			"txSpendLimit":     txSpendLimit,
-			"whitelist":        whitelist,
-			"blacklist":        blacklist,
-		},
+		Data: accountResponseData(vaultAccount),
 	}, nil
 }
 
+// accountResponseData returns the public details of an account (never the seed)
+func accountResponseData(account *Account) map[string]interface{} {
+	return map[string]interface{}{
+		"address":              account.Address,
+		"stellarAccountId":     account.AccountId,
+		"txSpendLimit":         account.TxSpendLimit,
+		"whitelist":            account.Whitelist,
+		"blacklist":            account.Blacklist,
+		"allowedAssets":        account.AllowedAssets,
+		"offerAssetPairs":      account.OfferAssetPairs,
+		"maxOfferAmount":       account.MaxOfferAmount,
+		"offerPriceBand":       account.OfferPriceBand,
+		"offerReferencePrices": account.OfferReferencePrices,
+		"approvalThreshold":    account.ApprovalThreshold,
+		"approvalQuorum":       account.ApprovalQuorum,
+		"approvalTTL":          account.ApprovalTTL,
+		"feeBumpMaxFee":        account.FeeBumpMaxFee,
+		"feeBumpDailyBudget":   account.FeeBumpDailyBudget,
+		"sponsorshipLimit":     account.SponsorshipLimit,
+		"role":                 account.Role,
+		"metadata":             account.Metadata,
+		"wallet":               account.Wallet,
+		"walletIndex":          account.WalletIndex,
+		"federationName":       account.FederationName,
+	}
+}
+
 func (b *backend) readVaultAccount(ctx context.Context, req *logical.Request, path string) (*Account, error) {
 	log.Print("Reading account from path: " + path)
 	entry, err := req.Storage.Get(ctx, path)
@@ -215,6 +574,41 @@ func (b *backend) readVaultAccount(ctx context.Context, req *logical.Request, pa
 	return &account, err
 }
 
+// fundAccount creates the account on the network with a starting balance paid by the funding account, subject to
+// the policies of the funding account. A starting balance above its approval threshold waits for a quorum of
+// approvers instead, and the approval is returned: the account then exists once the approved transaction is submitted.
+func (b *backend) fundAccount(ctx context.Context, req *logical.Request, fundingName string, funding *Account, address string, startingBalance decimal.Decimal) (*logical.Response, error) {
+	if err := b.validFunding(funding, address, startingBalance); err != nil {
+		return nil, err
+	}
+	decisions := append(policyDecisions(funding), fmt.Sprintf("starting balance of %s XLM paid by %s", startingBalance, fundingName))
+
+	opts, err := b.defaultTransactionOptions(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := b.buildTransaction(funding.Address, opts, &txnbuild.CreateAccount{
+		Destination: address,
+		Amount:      startingBalance.String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build create account object")
+	}
+
+	if requiresApproval(funding, startingBalance) {
+		return b.createApproval(ctx, req, tx, opts, decisions, nil, fundingName, funding, []string{fundingName})
+	}
+
+	signedTx, _, err := b.signTransaction(ctx, req, tx, decisions, funding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := b.horizon.SubmitTransaction(signedTx); err != nil {
+		return nil, logical.CodedError(400, "failed to submit transaction: "+errorString(err))
+	}
+	return nil, nil
+}
+
 // Using the Stellar testnet Friendbot, fund a test account with some lumens
 func fundTestAccount(address string) error {
 	resp, err := http.Get("https://horizon-testnet.stellar.org/friendbot?addr=" + address)
@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/txnbuild"
+	"strings"
+	"time"
+)
+
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+)
+
+// Approval is a transaction waiting for a quorum of approvers before it is signed
+type Approval struct {
+	ID                string              `json:"id"`
+	Account           string              `json:"account"`     // Name of the source account
+	Signers           []string            `json:"signers"`     // Names of the Vault accounts which may sign the transaction
+	Transaction       string              `json:"transaction"` // Unsigned transaction envelope
+	Options           *transactionOptions `json:"options"`     // Options the transaction is rebuilt with when signed
+	Decisions         []string            `json:"decisions"`   // Policy decisions made when the transaction was requested
+	Debit             *SubaccountDebit    `json:"debit"`       // Sub-account debited once the transaction is signed
+	Requester         string              `json:"requester"`   // Entity which requested the transaction
+	Quorum            int                 `json:"quorum"`
+	Approvers         []string            `json:"approvers"`
+	RejectedBy        string              `json:"rejected_by"`
+	Status            string              `json:"status"`
+	CreatedAt         time.Time           `json:"created_at"`
+	ExpiresAt         time.Time           `json:"expires_at"`
+	SignedTransaction string              `json:"signed_transaction"`
+	TransactionHash   string              `json:"transaction_hash"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func approvalsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "approvals/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listApprovals,
+			},
+		},
+		&framework.Path{
+			Pattern:      "approvals/" + framework.GenericNameRegex("id"),
+			HelpSynopsis: "Read a transaction waiting for approval",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.readApproval,
+			},
+		},
+		&framework.Path{
+			Pattern:      "approvals/" + framework.GenericNameRegex("id") + "/approve",
+			HelpSynopsis: "Approve a transaction, signing it once the quorum of approvers is reached",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.approveTransaction,
+				logical.UpdateOperation: b.approveTransaction,
+			},
+		},
+		&framework.Path{
+			Pattern:      "approvals/" + framework.GenericNameRegex("id") + "/reject",
+			HelpSynopsis: "Reject a transaction waiting for approval",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.rejectTransaction,
+				logical.UpdateOperation: b.rejectTransaction,
+			},
+		},
+	}
+}
+
+// requiresApproval returns whether a payment of the amount from the account needs approval before it is signed
+func requiresApproval(account *Account, amount decimal.Decimal) bool {
+	threshold, _ := decimal.NewFromString(account.ApprovalThreshold)
+	return threshold.IsPositive() && amount.GreaterThan(threshold)
+}
+
+// createApproval stores the unsigned transaction until a quorum of approvers has approved it
+func (b *backend) createApproval(ctx context.Context, req *logical.Request, tx *txnbuild.Transaction, opts *transactionOptions, decisions []string, debit *SubaccountDebit, accountName string, account *Account, signers []string) (*logical.Response, error) {
+	// Without an entity the requester could approve its own transaction, e.g. with a second root token
+	if req.EntityID == "" {
+		return nil, logical.CodedError(403, "transactions needing approval must be requested by a Vault entity")
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	txBase64, err := tx.Base64()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	approval := &Approval{
+		ID:          id,
+		Account:     accountName,
+		Signers:     signers,
+		Transaction: txBase64,
+		Options:     opts,
+		Decisions:   decisions,
+		Debit:       debit,
+		Requester:   req.EntityID,
+		Quorum:      account.ApprovalQuorum,
+		Status:      approvalPending,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(time.Duration(account.ApprovalTTL) * time.Second),
+	}
+	if approval.Quorum < 1 {
+		approval.Quorum = 1
+	}
+
+	if err := b.storeApproval(ctx, req, approval); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: approvalResponseData(approval),
+	}, nil
+}
+
+// Returns the ids of all stored approvals
+func (b *backend) listApprovals(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	approvals, err := req.Storage.List(ctx, "approvals/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(approvals), nil
+}
+
+// Returns the details of an approval
+func (b *backend) readApproval(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	approval, err := b.readStoredApproval(ctx, req, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if approval == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: approvalResponseData(approval),
+	}, nil
+}
+
+// Records the approval of the calling entity, and signs the transaction once the quorum is reached
+func (b *backend) approveTransaction(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	approval, resp, err := b.pendingApproval(ctx, req, d.Get("id").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	if contains(approval.Approvers, req.EntityID) {
+		return nil, logical.CodedError(409, "this entity has already approved the transaction")
+	}
+	approval.Approvers = append(approval.Approvers, req.EntityID)
+
+	if len(approval.Approvers) >= approval.Quorum {
+		if err := b.signApproval(ctx, req, approval); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.storeApproval(ctx, req, approval); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: approvalResponseData(approval),
+	}, nil
+}
+
+// Rejects the transaction, which can then no longer be approved
+func (b *backend) rejectTransaction(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.approvalLock.Lock()
+	defer b.approvalLock.Unlock()
+
+	approval, resp, err := b.pendingApproval(ctx, req, d.Get("id").(string))
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	approval.Status = approvalRejected
+	approval.RejectedBy = req.EntityID
+	if err := b.storeApproval(ctx, req, approval); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: approvalResponseData(approval),
+	}, nil
+}
+
+// pendingApproval loads an approval which the calling entity may still approve or reject
+func (b *backend) pendingApproval(ctx context.Context, req *logical.Request, id string) (*Approval, *logical.Response, error) {
+	if req.EntityID == "" {
+		return nil, nil, logical.CodedError(403, "approvers must be identified by a Vault entity")
+	}
+
+	approval, err := b.readStoredApproval(ctx, req, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if approval == nil {
+		return nil, nil, logical.CodedError(404, "approval not found")
+	}
+
+	if approval.Status == approvalPending && time.Now().After(approval.ExpiresAt) {
+		approval.Status = approvalExpired
+		if err := b.storeApproval(ctx, req, approval); err != nil {
+			return nil, nil, err
+		}
+	}
+	if approval.Status != approvalPending {
+		return nil, nil, logical.CodedError(409, fmt.Sprintf("the transaction is %s", approval.Status))
+	}
+
+	if approval.Requester != "" && approval.Requester == req.EntityID {
+		return nil, nil, logical.CodedError(403, "the requester of a transaction cannot approve or reject it")
+	}
+
+	return approval, nil, nil
+}
+
+// signApproval signs the approved transaction with the stored signers. The sequence number and time bounds are
+// refreshed since the source account may have submitted other transactions while waiting for approval.
+func (b *backend) signApproval(ctx context.Context, req *logical.Request, approval *Approval) error {
+	genericTx, err := txnbuild.TransactionFromXDR(approval.Transaction)
+	if err != nil {
+		return err
+	}
+	tx, ok := genericTx.Transaction()
+	if !ok {
+		return fmt.Errorf("stored transaction is not a regular transaction")
+	}
+
+	tx, err = b.rebuildTransaction(tx, approval.Options)
+	if err != nil {
+		return err
+	}
+
+	var candidates []*Account
+	for _, signer := range approval.Signers {
+		account, err := b.readVaultAccount(ctx, req, "accounts/"+signer)
+		if err != nil {
+			return err
+		}
+		if account == nil {
+			return logical.CodedError(400, "signer account not found: "+signer)
+		}
+		candidates = append(candidates, account)
+	}
+
+	// The balance of the sub-account may have been spent while waiting for approval, so it is checked again
+	decisions := append(approval.Decisions, fmt.Sprintf("approved by %s (quorum %d)", strings.Join(approval.Approvers, ","), approval.Quorum))
+	signedTx, _, err := b.signDebitedTransaction(ctx, req, tx, decisions, approval.Debit, candidates...)
+	if err != nil {
+		return err
+	}
+
+	approval.SignedTransaction, err = signedTx.Base64()
+	if err != nil {
+		return err
+	}
+	approval.TransactionHash, err = signedTx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return err
+	}
+	approval.Status = approvalApproved
+
+	return nil
+}
+
+func (b *backend) readStoredApproval(ctx context.Context, req *logical.Request, id string) (*Approval, error) {
+	entry, err := req.Storage.Get(ctx, "approvals/"+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read approval %s", id)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var approval Approval
+	if err := entry.DecodeJSON(&approval); err != nil {
+		return nil, fmt.Errorf("failed to deserialize approval %s", id)
+	}
+	return &approval, nil
+}
+
+func (b *backend) storeApproval(ctx context.Context, req *logical.Request, approval *Approval) error {
+	entry, err := logical.StorageEntryJSON("approvals/"+approval.ID, approval)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
+
+// approvalResponseData returns the details of an approval
+func approvalResponseData(approval *Approval) map[string]interface{} {
+	data := map[string]interface{}{
+		"approval_id": approval.ID,
+		"account":     approval.Account,
+		"status":      approval.Status,
+		"requester":   approval.Requester,
+		"quorum":      approval.Quorum,
+		"approvers":   approval.Approvers,
+		"transaction": approval.Transaction,
+		"created_at":  approval.CreatedAt,
+		"expires_at":  approval.ExpiresAt,
+	}
+	if approval.RejectedBy != "" {
+		data["rejected_by"] = approval.RejectedBy
+	}
+	if approval.Status == approvalApproved {
+		data["signed_transaction"] = approval.SignedTransaction
+		data["transaction_hash"] = approval.TransactionHash
+	}
+	return data
+}
@@ -0,0 +1,398 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/txnbuild"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditRecord is the immutable record of a transaction (or message) Vault signed
+type AuditRecord struct {
+	ID              string    `json:"id"`
+	TransactionHash string    `json:"transaction_hash"`
+	Envelope        string    `json:"envelope"` // Signed transaction envelope
+	Path            string    `json:"path"`     // Request path which signed the transaction
+	EntityID        string    `json:"entity_id"`
+	TokenAccessor   string    `json:"token_accessor"`
+	SourceAddress   string    `json:"source_address"`
+	Accounts        []string  `json:"accounts"` // Every source account of the transaction and its operations
+	Operations      []string  `json:"operations"`
+	Decisions       []string  `json:"decisions"` // Policies the transaction was checked against
+	Signers         []string  `json:"signers"`
+	MaxTime         int64     `json:"max_time"`  // Unix time after which the transaction can no longer be included in a ledger
+	Untracked       bool      `json:"untracked"` // The transaction can never be submitted, so its status isn't tracked
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func auditPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "audit/transactions/?",
+			HelpSynopsis: "List the transactions Vault has signed",
+			Fields: map[string]*framework.FieldSchema{
+				"account": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Only list transactions with this Vault account name, address or muxed address as a source account",
+				},
+				"hash": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Only list the transaction with this hash",
+				},
+				"start": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Only list transactions signed at or after this RFC3339 time",
+				},
+				"end": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Only list transactions signed before this RFC3339 time",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listAuditRecords,
+			},
+		},
+		&framework.Path{
+			Pattern:      "audit/transactions/" + framework.GenericNameRegex("id"),
+			HelpSynopsis: "Read the record of a signed transaction",
+			Fields: map[string]*framework.FieldSchema{
+				"id": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.readAuditRecord,
+			},
+		},
+	}
+}
+
+// Returns the ids of the audit records matching the filters, oldest first
+func (b *backend) listAuditRecords(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var start, end time.Time
+	var err error
+	if value := d.Get("start").(string); value != "" {
+		if start, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, logical.CodedError(400, "start must be an RFC3339 time")
+		}
+	}
+	if value := d.Get("end").(string); value != "" {
+		if end, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, logical.CodedError(400, "end must be an RFC3339 time")
+		}
+	}
+
+	var address string
+	if account := d.Get("account").(string); isMuxedAddress(account) {
+		address = account
+	} else if account != "" {
+		if address, err = b.resolveAddress(ctx, req, account); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+	}
+	hash := strings.ToLower(d.Get("hash").(string))
+
+	ids, err := req.Storage.List(ctx, "audit/transactions/")
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []string
+	recordInfo := make(map[string]interface{})
+	for _, id := range ids {
+		// Ids start with the signing time, so the time range doesn't need the record
+		signedAt, ok := auditRecordTime(id)
+		if !ok || (!start.IsZero() && signedAt.Before(start)) || (!end.IsZero() && !signedAt.Before(end)) {
+			continue
+		}
+
+		record, err := b.readStoredAuditRecord(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil || (hash != "" && record.TransactionHash != hash) || (address != "" && !contains(record.Accounts, address)) {
+			continue
+		}
+
+		matching = append(matching, id)
+		recordInfo[id] = map[string]interface{}{
+			"transaction_hash": record.TransactionHash,
+			"source_address":   record.SourceAddress,
+			"path":             record.Path,
+			"created_at":       record.CreatedAt,
+		}
+	}
+	return logical.ListResponseWithInfo(matching, recordInfo), nil
+}
+
+// Returns an audit record
+func (b *backend) readAuditRecord(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	record, err := b.readStoredAuditRecord(ctx, req.Storage, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: auditRecordResponseData(record),
+	}, nil
+}
+
+// auditTransaction records a signed transaction. The record is written before the signed transaction is returned,
+// so that nothing Vault signs goes unrecorded.
+func (b *backend) auditTransaction(ctx context.Context, req *logical.Request, tx *txnbuild.Transaction, decisions []string, explanation *SignatureExplanation) error {
+	envelope, err := tx.Base64()
+	if err != nil {
+		return err
+	}
+	hash, err := tx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return err
+	}
+
+	record := &AuditRecord{
+		TransactionHash: hash,
+		Envelope:        envelope,
+		SourceAddress:   tx.SourceAccount().AccountID,
+		Decisions:       decisions,
+		MaxTime:         tx.Timebounds().MaxTime,
+	}
+	// SEP-10 challenges have a zero sequence number, which no transaction submitted to the network can have
+	record.Untracked = tx.SourceAccount().Sequence == 0
+	record.addAccount(tx.SourceAccount().AccountID)
+	for _, op := range tx.Operations() {
+		if source := op.GetSourceAccount(); source != "" {
+			record.addAccount(source)
+		}
+		record.Operations = append(record.Operations, operationSummary(op))
+	}
+	if explanation != nil {
+		for _, signer := range explanation.Signers {
+			record.Signers = append(record.Signers, signer.Address)
+		}
+	}
+
+	return b.storeAuditRecord(ctx, req, record)
+}
+
+// addAccount adds a source account to the record. Muxed addresses are recorded together with their account, so that
+// the records of an account include those of its muxed addresses.
+func (record *AuditRecord) addAccount(address string) {
+	for _, account := range []string{baseAddress(address), address} {
+		if !contains(record.Accounts, account) {
+			record.Accounts = append(record.Accounts, account)
+		}
+	}
+}
+
+// auditFeeBump records a signed fee bump transaction
+func (b *backend) auditFeeBump(ctx context.Context, req *logical.Request, tx *txnbuild.FeeBumpTransaction, decisions []string, explanation *SignatureExplanation) error {
+	envelope, err := tx.Base64()
+	if err != nil {
+		return err
+	}
+	hash, err := tx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return err
+	}
+
+	inner := tx.InnerTransaction()
+	record := &AuditRecord{
+		TransactionHash: hash,
+		Envelope:        envelope,
+		SourceAddress:   tx.FeeAccount(),
+		Accounts:        []string{tx.FeeAccount(), inner.SourceAccount().AccountID},
+		Operations:      []string{fmt.Sprintf("FeeBump fee=%d inner=%s", tx.MaxFee(), inner.SourceAccount().AccountID)},
+		Decisions:       decisions,
+		MaxTime:         inner.Timebounds().MaxTime,
+	}
+	if explanation != nil {
+		for _, signer := range explanation.Signers {
+			record.Signers = append(record.Signers, signer.Address)
+		}
+	}
+
+	return b.storeAuditRecord(ctx, req, record)
+}
+
+func (b *backend) storeAuditRecord(ctx context.Context, req *logical.Request, record *AuditRecord) error {
+	suffix, err := uuid.GenerateUUID()
+	if err != nil {
+		return err
+	}
+
+	// Prefix the id with the signing time so that ids sort by time and the retention can be applied from the id alone
+	record.CreatedAt = time.Now().UTC()
+	record.ID = fmt.Sprintf("%019d-%s", record.CreatedAt.UnixNano(), suffix[:8])
+	record.Path = req.Path
+	record.EntityID = req.EntityID
+	record.TokenAccessor = req.ClientTokenAccessor
+
+	entry, err := logical.StorageEntryJSON("audit/transactions/"+record.ID, record)
+	if err != nil {
+		return err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to write audit record: %s", err)
+	}
+
+	// Track the transaction until it lands or expires. Records of signed messages have no transaction.
+	if record.TransactionHash == "" || record.Untracked {
+		return nil
+	}
+	return b.storeTransactionStatus(ctx, req.Storage, &TransactionStatus{
+		TransactionHash: record.TransactionHash,
+		AuditID:         record.ID,
+		Status:          txStatusPending,
+		MaxTime:         record.MaxTime,
+	})
+}
+
+func (b *backend) readStoredAuditRecord(ctx context.Context, s logical.Storage, id string) (*AuditRecord, error) {
+	entry, err := s.Get(ctx, "audit/transactions/"+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit record %s", id)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var record AuditRecord
+	if err := entry.DecodeJSON(&record); err != nil {
+		return nil, fmt.Errorf("failed to deserialize audit record %s", id)
+	}
+	return &record, nil
+}
+
+// pruneAuditRecords deletes the audit records older than the configured retention
+func (b *backend) pruneAuditRecords(ctx context.Context, s logical.Storage) error {
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if config.AuditRetention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-time.Duration(config.AuditRetention) * time.Second)
+
+	ids, err := s.List(ctx, "audit/transactions/")
+	if err != nil {
+		return err
+	}
+	pruned := 0
+	for _, id := range ids {
+		signedAt, ok := auditRecordTime(id)
+		if !ok || !signedAt.Before(cutoff) {
+			continue
+		}
+		record, err := b.readStoredAuditRecord(ctx, s, id)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			if err := s.Delete(ctx, "transaction_status/"+record.TransactionHash); err != nil {
+				return err
+			}
+		}
+		if err := s.Delete(ctx, "audit/transactions/"+id); err != nil {
+			return err
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Printf("pruned %d audit records older than %v", pruned, cutoff)
+	}
+	return nil
+}
+
+// auditRecordTime returns the signing time encoded in an audit record id
+func auditRecordTime(id string) (time.Time, bool) {
+	nanos, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos).UTC(), true
+}
+
+// policyDecisions lists the policies of the account which a transaction was checked against
+func policyDecisions(account *Account) []string {
+	var decisions []string
+	if txLimit, _ := decimal.NewFromString(account.TxSpendLimit); txLimit.IsPositive() {
+		decisions = append(decisions, "tx_spend_limit "+account.TxSpendLimit)
+	}
+	if len(account.Whitelist) > 0 {
+		decisions = append(decisions, fmt.Sprintf("whitelist (%d entries)", len(account.Whitelist)))
+	}
+	if len(account.Blacklist) > 0 {
+		decisions = append(decisions, fmt.Sprintf("blacklist (%d entries)", len(account.Blacklist)))
+	}
+	if len(account.AllowedAssets) > 0 {
+		decisions = append(decisions, "allowed_assets "+strings.Join(account.AllowedAssets, ","))
+	}
+	return decisions
+}
+
+// operationSummary returns a short human readable description of an operation
+func operationSummary(op txnbuild.Operation) string {
+	switch o := op.(type) {
+	case *txnbuild.Payment:
+		return fmt.Sprintf("Payment %s %s to %s", o.Amount, assetString(o.Asset), o.Destination)
+	case *txnbuild.CreateAccount:
+		return fmt.Sprintf("CreateAccount %s with %s XLM", o.Destination, o.Amount)
+	case *txnbuild.AccountMerge:
+		return fmt.Sprintf("AccountMerge into %s", o.Destination)
+	case *txnbuild.CreateClaimableBalance:
+		return fmt.Sprintf("CreateClaimableBalance %s %s for %d claimants", o.Amount, assetString(o.Asset), len(o.Destinations))
+	case *txnbuild.ManageSellOffer:
+		return fmt.Sprintf("ManageSellOffer %d: %s %s for %s at %s", o.OfferID, o.Amount, assetString(o.Selling), assetString(o.Buying), o.Price.String())
+	case *txnbuild.ManageBuyOffer:
+		return fmt.Sprintf("ManageBuyOffer %d: %s %s for %s at %s", o.OfferID, o.Amount, assetString(o.Buying), assetString(o.Selling), o.Price.String())
+	case *txnbuild.ManageData:
+		return fmt.Sprintf("ManageData %s on %s", o.Name, o.SourceAccount)
+	default:
+		return strings.TrimPrefix(fmt.Sprintf("%T", op), "*txnbuild.")
+	}
+}
+
+// auditRecordResponseData returns the details of an audit record
+func auditRecordResponseData(record *AuditRecord) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               record.ID,
+		"transaction_hash": record.TransactionHash,
+		"envelope":         record.Envelope,
+		"path":             record.Path,
+		"entity_id":        record.EntityID,
+		"token_accessor":   record.TokenAccessor,
+		"source_address":   record.SourceAddress,
+		"accounts":         record.Accounts,
+		"operations":       record.Operations,
+		"decisions":        record.Decisions,
+		"signers":          record.Signers,
+		"max_time":         record.MaxTime,
+		"created_at":       record.CreatedAt,
+	}
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+	"github.com/stellar/go/xdr"
+	"net/http"
+)
+
+// Claimant is a recipient of a claimable balance along with the predicate under which it may claim
+type Claimant struct {
+	Destination string          `json:"destination"` // A Stellar address or the name of a Vault account
+	Predicate   *ClaimPredicate `json:"predicate,omitempty"`
+}
+
+// ClaimPredicate is the JSON representation of a Stellar claim predicate. Type is one of unconditional,
+// before_absolute_time, after_absolute_time, before_relative_time, after_relative_time, and, or, not.
+type ClaimPredicate struct {
+	Type       string           `json:"type"`
+	Time       int64            `json:"time,omitempty"`    // Unix epoch seconds, for the absolute time predicates
+	Seconds    int64            `json:"seconds,omitempty"` // Seconds since the balance was created, for the relative time predicates
+	Predicates []ClaimPredicate `json:"predicates,omitempty"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func claimableBalancesPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "claimable_balances",
+			HelpSynopsis: "Create a claimable balance on the Stellar network",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"source": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Source account",
+				},
+				"claimants": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "JSON array of claimants, e.g. [{\"destination\":\"G...\",\"predicate\":{\"type\":\"before_relative_time\",\"seconds\":86400}}]",
+				},
+				"amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Amount of the balance",
+				},
+				"assetCode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Code of asset to send (use 'native' for XLM)",
+				},
+				"assetIssuer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) If using a non-native asset, this is the issuer address",
+				},
+				"memo": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) An optional memo to include with the transaction",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.createClaimableBalance),
+				logical.UpdateOperation: b.idempotent(b.createClaimableBalance),
+			},
+		},
+		&framework.Path{
+			Pattern:      "claimable_balances/claim",
+			HelpSynopsis: "Claim a claimable balance on behalf of a Vault account",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"account": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Claimant account",
+				},
+				"balanceId": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Hex encoded id of the claimable balance",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.claimClaimableBalance),
+				logical.UpdateOperation: b.idempotent(b.claimClaimableBalance),
+			},
+		},
+	}
+}
+
+// Creates a signed transaction with a create claimable balance operation.
+func (b *backend) createClaimableBalance(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	source := d.Get("source").(string)
+	if source == "" {
+		return errMissingField("source"), nil
+	}
+
+	claimantsJSON := d.Get("claimants").(string)
+	if claimantsJSON == "" {
+		return errMissingField("claimants"), nil
+	}
+
+	amountStr := d.Get("amount").(string)
+	if amountStr == "" {
+		return errMissingField("amount"), nil
+	}
+	amount := validNumber(amountStr)
+
+	assetCode := d.Get("assetCode").(string)
+	if assetCode == "" {
+		return errMissingField("assetCode"), nil
+	}
+
+	// Read optional fields
+	assetIssuer := d.Get("assetIssuer").(string)
+	memo := d.Get("memo").(string)
+
+	asset, err := buildAsset(assetCode, assetIssuer)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Retrieve the source account keypair from vault storage
+	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+source)
+	if err != nil {
+		return nil, err
+	}
+	if sourceAccount == nil {
+		return nil, logical.CodedError(400, "source account not found")
+	}
+	if valid, err := b.validAssetConstraints(sourceAccount, asset); !valid {
+		return nil, err
+	}
+
+	var claimants []Claimant
+	if err := json.Unmarshal([]byte(claimantsJSON), &claimants); err != nil {
+		return nil, logical.CodedError(400, "claimants is not a valid JSON array")
+	}
+	if len(claimants) == 0 {
+		return nil, logical.CodedError(400, "at least one claimant is required")
+	}
+
+	// Build the claimants, validating each destination against the source account constraints
+	var destinations []txnbuild.Claimant
+	for _, claimant := range claimants {
+		destinationAddress, err := b.resolveAddress(ctx, req, claimant.Destination)
+		if err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+
+		if valid, err := b.validAccountConstraints(sourceAccount, amount, destinationAddress); !valid {
+			return nil, err
+		}
+
+		predicate := txnbuild.UnconditionalPredicate
+		if claimant.Predicate != nil {
+			predicate, err = buildClaimPredicate(*claimant.Predicate)
+			if err != nil {
+				return nil, logical.CodedError(400, err.Error())
+			}
+		}
+		destinations = append(destinations, txnbuild.NewClaimant(destinationAddress, &predicate))
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+	opts.Memo = memo
+
+	tx, err := b.buildTransaction(sourceAccount.Address, opts, &txnbuild.CreateClaimableBalance{
+		Destinations: destinations,
+		Amount:       amount.String(),
+		Asset:        asset,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build claimable balance object")
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, policyDecisions(sourceAccount), sourceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.signedTransactionResponse(signedTx, explanation)
+	if err != nil {
+		return nil, err
+	}
+
+	// The balance id is derived from the source account and sequence number of the transaction
+	balanceID, err := signedTx.ClaimableBalanceID(0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["balance_id"] = balanceID
+
+	return resp, nil
+}
+
+// Creates a signed transaction with a claim claimable balance operation.
+func (b *backend) claimClaimableBalance(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	accountName := d.Get("account").(string)
+	if accountName == "" {
+		return errMissingField("account"), nil
+	}
+
+	balanceID := d.Get("balanceId").(string)
+	if balanceID == "" {
+		return errMissingField("balanceId"), nil
+	}
+	var xdrBalanceID xdr.ClaimableBalanceId
+	if err := xdr.SafeUnmarshalHex(balanceID, &xdrBalanceID); err != nil {
+		return nil, logical.CodedError(400, "invalid balanceId")
+	}
+
+	// Retrieve the claimant account keypair from vault storage
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, &txnbuild.ClaimClaimableBalance{
+		BalanceID: balanceID,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build claim object")
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, nil, account)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.signedTransactionResponse(signedTx, explanation)
+}
+
+// buildClaimPredicate converts the JSON representation of a predicate into its XDR form
+func buildClaimPredicate(p ClaimPredicate) (xdr.ClaimPredicate, error) {
+	switch p.Type {
+	case "unconditional":
+		return txnbuild.UnconditionalPredicate, nil
+	case "before_absolute_time":
+		return txnbuild.BeforeAbsoluteTimePredicate(p.Time), nil
+	case "after_absolute_time":
+		return txnbuild.NotPredicate(txnbuild.BeforeAbsoluteTimePredicate(p.Time)), nil
+	case "before_relative_time":
+		return txnbuild.BeforeRelativeTimePredicate(p.Seconds), nil
+	case "after_relative_time":
+		return txnbuild.NotPredicate(txnbuild.BeforeRelativeTimePredicate(p.Seconds)), nil
+	case "and", "or":
+		if len(p.Predicates) != 2 {
+			return xdr.ClaimPredicate{}, fmt.Errorf("%s predicate requires exactly two predicates", p.Type)
+		}
+		left, err := buildClaimPredicate(p.Predicates[0])
+		if err != nil {
+			return xdr.ClaimPredicate{}, err
+		}
+		right, err := buildClaimPredicate(p.Predicates[1])
+		if err != nil {
+			return xdr.ClaimPredicate{}, err
+		}
+		if p.Type == "and" {
+			return txnbuild.AndPredicate(left, right), nil
+		}
+		return txnbuild.OrPredicate(left, right), nil
+	case "not":
+		if len(p.Predicates) != 1 {
+			return xdr.ClaimPredicate{}, fmt.Errorf("not predicate requires exactly one predicate")
+		}
+		inner, err := buildClaimPredicate(p.Predicates[0])
+		if err != nil {
+			return xdr.ClaimPredicate{}, err
+		}
+		return txnbuild.NotPredicate(inner), nil
+	default:
+		return xdr.ClaimPredicate{}, fmt.Errorf("unknown predicate type '%s'", p.Type)
+	}
+}
+
+// resolveAddress returns the given value if it is a Stellar address, otherwise the address of the named Vault account
+func (b *backend) resolveAddress(ctx context.Context, req *logical.Request, nameOrAddress string) (string, error) {
+	if _, err := keypair.ParseAddress(nameOrAddress); err == nil {
+		return nameOrAddress, nil
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+nameOrAddress)
+	if err != nil {
+		return "", err
+	}
+	if account == nil {
+		return "", fmt.Errorf("account not found: %s", nameOrAddress)
+	}
+	return account.Address, nil
+}
+
+// hasTrustline returns whether the given address exists and can hold the asset
+func (b *backend) hasTrustline(address string, asset txnbuild.Asset) (bool, error) {
+	if asset.IsNative() {
+		return true, nil
+	}
+
+	account, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: address})
+	if err != nil {
+		if herr, ok := err.(*horizonclient.Error); ok && herr.Problem.Status == http.StatusNotFound {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to load destination account")
+	}
+
+	for _, balance := range account.Balances {
+		if balance.Asset.Code == asset.GetCode() && balance.Asset.Issuer == asset.GetIssuer() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
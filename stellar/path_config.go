@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"strings"
+)
+
+const (
+	feeModeFixed   = "fixed"
+	feeModeDynamic = "dynamic"
+)
+
+// Config is the backend wide configuration
+type Config struct {
+	FeeMode        string `json:"fee_mode"`        // fixed or dynamic
+	BaseFee        int64  `json:"base_fee"`        // Base fee per operation in stroops, in fixed mode
+	FeePercentile  int    `json:"fee_percentile"`  // Percentile of recently charged fees to bid, in dynamic mode
+	MaxBaseFee     int64  `json:"max_base_fee"`    // Cap on the base fee, including per-request overrides (0 is no cap)
+	TxTimeout      int64  `json:"tx_timeout"`      // Seconds a signed transaction is valid for, unless the request sets time bounds
+	AuditRetention int64  `json:"audit_retention"` // Seconds audit records are kept for (0 keeps them forever)
+
+	// Seconds a request repeated with the same idempotency key returns the original response
+	IdempotencyWindow int64 `json:"idempotency_window"`
+
+	// Seconds the status of a transaction is kept for once it succeeded, failed or expired
+	TransactionStatusRetention int64 `json:"transaction_status_retention"`
+
+	// Seconds resolved federation addresses are cached for (0 disables caching)
+	FederationCacheTTL int64 `json:"federation_cache_ttl"`
+
+	// Domain of the federation addresses of Vault accounts
+	FederationDomain string `json:"federation_domain"`
+
+	// Vault account whose key signs generated SEP-7 URIs, published as the URI_REQUEST_SIGNING_KEY of the origin domain
+	URISigningAccount string `json:"uri_signing_account"`
+	URIOriginDomain   string `json:"uri_origin_domain"`
+}
+
+// Percentiles reported by the Horizon fee stats
+var feePercentiles = []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 95, 99}
+
+// Register the callbacks for the paths exposed by these functions
+func configPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "config",
+			HelpSynopsis: "Configure the Stellar secrets backend",
+			Fields: map[string]*framework.FieldSchema{
+				"fee_mode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "'fixed' to always bid base_fee, or 'dynamic' to bid a percentile of recently charged fees",
+				},
+				"base_fee": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "Base fee per operation in stroops, used in fixed mode",
+				},
+				"fee_percentile": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "Percentile of recently charged fees to bid in dynamic mode (10, 20, ..., 90, 95 or 99)",
+				},
+				"max_base_fee": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "Maximum base fee per operation in stroops, including per-request max_fee overrides (0 is no cap)",
+				},
+				"tx_timeout": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "How long signed transactions are valid for, unless the request sets time bounds",
+				},
+				"audit_retention": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the records of signed transactions are kept for (0 keeps them forever)",
+				},
+				"idempotency_window": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "How long a request repeated with the same idempotency_key returns the original response",
+				},
+				"transaction_status_retention": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "How long the status of a transaction is kept for once it succeeded, failed or expired",
+				},
+				"federation_domain": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Domain of the federation addresses (name*domain) of Vault accounts",
+				},
+				"uri_signing_account": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Account whose key signs generated SEP-7 URIs, published as URI_REQUEST_SIGNING_KEY in the stellar.toml of uri_origin_domain",
+				},
+				"uri_origin_domain": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Origin domain of generated SEP-7 URIs",
+				},
+				"federation_cache_ttl": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "How long resolved federation addresses are cached for (0 disables caching)",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathReadConfig,
+				logical.CreateOperation: b.pathWriteConfig,
+				logical.UpdateOperation: b.pathWriteConfig,
+			},
+		},
+	}
+}
+
+// Returns the backend configuration
+func (b *backend) pathReadConfig(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: configResponseData(config),
+	}, nil
+}
+
+// Updates the fields of the backend configuration given in the request
+func (b *backend) pathWriteConfig(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if feeMode, ok := d.GetOk("fee_mode"); ok {
+		config.FeeMode = feeMode.(string)
+		if config.FeeMode != feeModeFixed && config.FeeMode != feeModeDynamic {
+			return nil, logical.CodedError(400, "fee_mode must be 'fixed' or 'dynamic'")
+		}
+	}
+	if baseFee, ok := d.GetOk("base_fee"); ok {
+		config.BaseFee = int64(baseFee.(int))
+		if config.BaseFee < 0 {
+			return nil, logical.CodedError(400, "base_fee must not be negative")
+		}
+	}
+	if feePercentile, ok := d.GetOk("fee_percentile"); ok {
+		config.FeePercentile = feePercentile.(int)
+		valid := false
+		for _, percentile := range feePercentiles {
+			valid = valid || percentile == config.FeePercentile
+		}
+		if !valid {
+			return nil, logical.CodedError(400, fmt.Sprintf("fee_percentile must be one of %v", feePercentiles))
+		}
+	}
+	if maxBaseFee, ok := d.GetOk("max_base_fee"); ok {
+		config.MaxBaseFee = int64(maxBaseFee.(int))
+		if config.MaxBaseFee < 0 {
+			return nil, logical.CodedError(400, "max_base_fee must not be negative")
+		}
+	}
+
+	if txTimeout, ok := d.GetOk("tx_timeout"); ok {
+		config.TxTimeout = int64(txTimeout.(int))
+		if config.TxTimeout <= 0 {
+			return nil, logical.CodedError(400, "tx_timeout must be positive")
+		}
+	}
+	if auditRetention, ok := d.GetOk("audit_retention"); ok {
+		config.AuditRetention = int64(auditRetention.(int))
+		if config.AuditRetention < 0 {
+			return nil, logical.CodedError(400, "audit_retention must not be negative")
+		}
+	}
+	if idempotencyWindow, ok := d.GetOk("idempotency_window"); ok {
+		config.IdempotencyWindow = int64(idempotencyWindow.(int))
+		if config.IdempotencyWindow <= 0 {
+			return nil, logical.CodedError(400, "idempotency_window must be positive")
+		}
+	}
+	if transactionStatusRetention, ok := d.GetOk("transaction_status_retention"); ok {
+		config.TransactionStatusRetention = int64(transactionStatusRetention.(int))
+		if config.TransactionStatusRetention <= 0 {
+			return nil, logical.CodedError(400, "transaction_status_retention must be positive")
+		}
+	}
+	if federationDomain, ok := d.GetOk("federation_domain"); ok {
+		config.FederationDomain = strings.ToLower(federationDomain.(string))
+	}
+	if uriSigningAccount, ok := d.GetOk("uri_signing_account"); ok {
+		config.URISigningAccount = uriSigningAccount.(string)
+	}
+	if uriOriginDomain, ok := d.GetOk("uri_origin_domain"); ok {
+		config.URIOriginDomain = strings.ToLower(uriOriginDomain.(string))
+	}
+	if federationCacheTTL, ok := d.GetOk("federation_cache_ttl"); ok {
+		config.FederationCacheTTL = int64(federationCacheTTL.(int))
+		if config.FederationCacheTTL < 0 {
+			return nil, logical.CodedError(400, "federation_cache_ttl must not be negative")
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON("config", config)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: configResponseData(config),
+	}, nil
+}
+
+// readConfig returns the stored configuration, or the defaults if none has been written
+func (b *backend) readConfig(ctx context.Context, s logical.Storage) (*Config, error) {
+	config := &Config{
+		FeeMode:       feeModeFixed,
+		FeePercentile: 50,
+		TxTimeout:     300,
+
+		IdempotencyWindow:          86400,
+		TransactionStatusRetention: 604800,
+		FederationCacheTTL:         300,
+	}
+
+	entry, err := s.Get(ctx, "config")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config")
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return config, nil
+	}
+
+	if err := entry.DecodeJSON(config); err != nil {
+		return nil, fmt.Errorf("failed to deserialize config")
+	}
+	return config, nil
+}
+
+// configResponseData returns the details of the configuration
+func configResponseData(config *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"fee_mode":                     config.FeeMode,
+		"base_fee":                     config.BaseFee,
+		"fee_percentile":               config.FeePercentile,
+		"max_base_fee":                 config.MaxBaseFee,
+		"tx_timeout":                   config.TxTimeout,
+		"audit_retention":              config.AuditRetention,
+		"idempotency_window":           config.IdempotencyWindow,
+		"transaction_status_retention": config.TransactionStatusRetention,
+		"federation_cache_ttl":         config.FederationCacheTTL,
+		"federation_domain":            config.FederationDomain,
+		"uri_signing_account":          config.URISigningAccount,
+		"uri_origin_domain":            config.URIOriginDomain,
+	}
+}
@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Type of the secret leased for accounts issued by creds/<role>
+const secretTypeAccount = "stellar_account"
+
+// secretAccount revokes issued accounts by merging them back into the account which funded them
+func secretAccount(b *backend) *framework.Secret {
+	return &framework.Secret{
+		Type: secretTypeAccount,
+		Fields: map[string]*framework.FieldSchema{
+			"account_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the issued Vault account",
+			},
+			"address": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Stellar address of the issued account",
+			},
+		},
+		Renew:  b.renewCreds,
+		Revoke: b.revokeCreds,
+	}
+}
+
+// Register the callbacks for the paths exposed by these functions
+func credsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "creds/" + framework.GenericNameRegex("role"),
+			HelpSynopsis: "Issue a funded, short-lived Stellar account from a role",
+			Fields: map[string]*framework.FieldSchema{
+				"role": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.issueCreds,
+			},
+		},
+	}
+}
+
+// Creates an account funded by the role's funding account, stores it with the role's policies and leases it
+func (b *backend) issueCreds(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName := d.Get("role").(string)
+	role, err := b.readStoredRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, logical.CodedError(404, "role not found")
+	}
+
+	funding, err := b.readVaultAccount(ctx, req, "accounts/"+role.FundingAccount)
+	if err != nil {
+		return nil, err
+	}
+	if role.FundingAccount == "" {
+		return nil, logical.CodedError(400, "role has no funding_account")
+	}
+	if funding == nil {
+		return nil, logical.CodedError(400, "funding account not found: "+role.FundingAccount)
+	}
+
+	// Issued accounts are needed right away, so they can't wait for the approval of their starting balance
+	startingBalance, err := decimal.NewFromString(role.StartingBalance)
+	if err != nil {
+		return nil, err
+	}
+	if requiresApproval(funding, startingBalance) {
+		return nil, logical.CodedError(403, "the starting_balance of the role is above the approval_threshold of "+role.FundingAccount)
+	}
+
+	// Hold the lock until the account is stored, so that concurrent requests can't exceed the lease limit
+	b.credsLock.Lock()
+	defer b.credsLock.Unlock()
+
+	if role.MaxLeases > 0 {
+		leases, err := b.countLeases(ctx, req, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if leases >= role.MaxLeases {
+			return nil, logical.CodedError(403, fmt.Sprintf("role %s already has %d leased accounts", roleName, leases))
+		}
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	accountName := fmt.Sprintf("creds-%s-%s", roleName, id[:8])
+
+	random, err := keypair.Random()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := b.fundAccount(ctx, req, role.FundingAccount, funding, random.Address(), startingBalance); err != nil {
+		return nil, err
+	}
+
+	account := &Account{
+		Address:       random.Address(),
+		Seed:          random.Seed(),
+		AccountId:     random.Address(),
+		TxSpendLimit:  role.TxSpendLimit,
+		Whitelist:     role.Whitelist,
+		Blacklist:     role.Blacklist,
+		AllowedAssets: role.AllowedAssets,
+		Role:          roleName,
+		Metadata:      role.Metadata,
+	}
+	if err := b.setAccountFlags(ctx, req, account, role.Flags); err != nil {
+		return nil, err
+	}
+
+	entry, err := logical.StorageEntryJSON("accounts/"+accountName, account)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	log.Printf("issued account %v from role %v", account.Address, roleName)
+
+	resp := b.Secret(secretTypeAccount).Response(map[string]interface{}{
+		"account_name": accountName,
+		"address":      account.Address,
+	}, map[string]interface{}{
+		"account_name":    accountName,
+		"role":            roleName,
+		"funding_address": funding.Address,
+	})
+	resp.Secret.TTL = time.Duration(role.TTL) * time.Second
+	resp.Secret.MaxTTL = time.Duration(role.MaxTTL) * time.Second
+	return resp, nil
+}
+
+// Extends the lease of an issued account within the limits of its role
+func (b *backend) renewCreds(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roleName, _ := req.Secret.InternalData["role"].(string)
+	role, err := b.readStoredRole(ctx, req.Storage, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+	if role != nil {
+		resp.Secret.TTL = time.Duration(role.TTL) * time.Second
+		resp.Secret.MaxTTL = time.Duration(role.MaxTTL) * time.Second
+	}
+	return resp, nil
+}
+
+// Merges an issued account back into the account which funded it and deletes its key. If the merge fails (e.g. the
+// account still holds trustlines) the error is returned, so that Vault retries the revocation.
+func (b *backend) revokeCreds(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accountName, _ := req.Secret.InternalData["account_name"].(string)
+	fundingAddress, _ := req.Secret.InternalData["funding_address"].(string)
+	if accountName == "" || fundingAddress == "" {
+		return nil, fmt.Errorf("secret is missing internal data")
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, nil
+	}
+
+	// An account which no longer exists on the network was already merged
+	exists, err := b.accountExists(account.Address)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		opts, err := b.defaultTransactionOptions(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		tx, err := b.buildTransaction(account.Address, opts, &txnbuild.AccountMerge{Destination: fundingAddress})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to build account merge object")
+		}
+		signedTx, _, err := b.signTransaction(ctx, req, tx, nil, account)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := b.horizon.SubmitTransaction(signedTx); err != nil {
+			return nil, fmt.Errorf("failed to merge issued account %s: %s", account.Address, errorString(err))
+		}
+	}
+
+	b.invalidateSigners(account.Address)
+	if err := req.Storage.Delete(ctx, "accounts/"+accountName); err != nil {
+		return nil, err
+	}
+
+	log.Printf("revoked account %v", account.Address)
+	return nil, nil
+}
+
+// countLeases returns the number of accounts issued from the role which haven't been revoked yet
+func (b *backend) countLeases(ctx context.Context, req *logical.Request, roleName string) (int, error) {
+	accountNames, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return 0, err
+	}
+
+	leases := 0
+	for _, accountName := range accountNames {
+		if !strings.HasPrefix(accountName, "creds-"+roleName+"-") {
+			continue
+		}
+		// Another role's name may start with this one's, so the role the account was issued from is checked
+		account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+		if err != nil {
+			return 0, err
+		}
+		if account != nil && account.Role == roleName {
+			leases++
+		}
+	}
+	return leases, nil
+}
+
+// accountExists returns whether the account exists on the network
+func (b *backend) accountExists(address string) (bool, error) {
+	_, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: address})
+	if herr, ok := err.(*horizonclient.Error); ok && herr.Problem.Status == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to load account "+address)
+	}
+	return true, nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"filippo.io/edwards25519"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/strkey"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Register the callbacks for the paths exposed by these functions
+func encryptionPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/encrypt",
+			HelpSynopsis: "Encrypt data from the account to any account address",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"recipient": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Address of the account the data is encrypted for",
+				},
+				"plaintext": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Base64 encoded data to encrypt",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.encrypt,
+				logical.UpdateOperation: b.encrypt,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/decrypt",
+			HelpSynopsis: "Decrypt data sent to the account by any account address",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"sender": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Address of the account which encrypted the data",
+				},
+				"ciphertext": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Base64 encoded nonce followed by the sealed box",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.decrypt,
+				logical.UpdateOperation: b.decrypt,
+			},
+		},
+	}
+}
+
+// Seals the data in an authenticated box from the account to the recipient. The result is the random 24 byte
+// nonce followed by the box.
+func (b *backend) encrypt(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	recipient := d.Get("recipient").(string)
+	if recipient == "" {
+		return errMissingField("recipient"), nil
+	}
+	plaintextBase64 := d.Get("plaintext").(string)
+	if plaintextBase64 == "" {
+		return errMissingField("plaintext"), nil
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(plaintextBase64)
+	if err != nil {
+		return nil, logical.CodedError(400, "plaintext is not valid base64")
+	}
+
+	privateKey, account, err := b.accountBoxKey(ctx, req, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := addressBoxKey(recipient)
+	if err != nil {
+		return nil, logical.CodedError(400, "recipient: "+err.Error())
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	ciphertext := box.Seal(nonce[:], plaintext, &nonce, publicKey, privateKey)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"sender":     account.Address,
+			"recipient":  recipient,
+			"ciphertext": base64.StdEncoding.EncodeToString(ciphertext),
+		},
+	}, nil
+}
+
+// Opens an authenticated box sent to the account by the sender
+func (b *backend) decrypt(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	sender := d.Get("sender").(string)
+	if sender == "" {
+		return errMissingField("sender"), nil
+	}
+	ciphertextBase64 := d.Get("ciphertext").(string)
+	if ciphertextBase64 == "" {
+		return errMissingField("ciphertext"), nil
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextBase64)
+	if err != nil || len(ciphertext) < 24+box.Overhead {
+		return nil, logical.CodedError(400, "ciphertext is not a valid base64 encoded box")
+	}
+
+	privateKey, _, err := b.accountBoxKey(ctx, req, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := addressBoxKey(sender)
+	if err != nil {
+		return nil, logical.CodedError(400, "sender: "+err.Error())
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], ciphertext[:24])
+	plaintext, ok := box.Open(nil, ciphertext[24:], &nonce, publicKey, privateKey)
+	if !ok {
+		return nil, logical.CodedError(400, "ciphertext could not be decrypted from "+sender)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		},
+	}, nil
+}
+
+// accountBoxKey returns the curve25519 private key of the account, derived from its ed25519 seed the same way as
+// the ed25519 signing scalar
+func (b *backend) accountBoxKey(ctx context.Context, req *logical.Request, name string) (*[32]byte, *Account, error) {
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if account == nil {
+		return nil, nil, logical.CodedError(400, "account not found")
+	}
+
+	seed, err := strkey.Decode(strkey.VersionByteSeed, account.Seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha512.Sum512(seed)
+	digest[0] &= 248
+	digest[31] &= 127
+	digest[31] |= 64
+
+	var privateKey [32]byte
+	copy(privateKey[:], digest[:32])
+	return &privateKey, account, nil
+}
+
+// addressBoxKey returns the curve25519 public key of the account address, the Montgomery form of its ed25519 key
+func addressBoxKey(address string) (*[32]byte, error) {
+	raw, err := strkey.Decode(strkey.VersionByteAccountID, address)
+	if err != nil {
+		return nil, err
+	}
+	point, err := new(edwards25519.Point).SetBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var publicKey [32]byte
+	copy(publicKey[:], point.BytesMontgomery())
+	return &publicKey, nil
+}
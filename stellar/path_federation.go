@@ -0,0 +1,183 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/strkey"
+	"strings"
+)
+
+// FederationRecord maps a federation name or account address to the Vault account it belongs to
+type FederationRecord struct {
+	AccountName string `json:"account_name"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func federationPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "federation",
+			HelpSynopsis: "Answer SEP-2 federation queries for the federation names of Vault accounts",
+			Fields: map[string]*framework.FieldSchema{
+				"q": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Federation address (name*domain) for name queries, account address for id queries",
+				},
+				"type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Query type: name or id",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.federationLookup,
+			},
+		},
+	}
+}
+
+// Resolves a federation address to its account, or an account address back to its federation address
+func (b *backend) federationLookup(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	q := d.Get("q").(string)
+	if q == "" {
+		return errMissingField("q"), nil
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config.FederationDomain == "" {
+		return nil, logical.CodedError(400, "federation_domain is not configured")
+	}
+
+	var path string
+	switch d.Get("type").(string) {
+	case "name":
+		separator := strings.LastIndex(q, "*")
+		if separator < 0 || !strings.EqualFold(q[separator+1:], config.FederationDomain) {
+			return nil, logical.CodedError(404, "not found")
+		}
+		path = "federation/names/" + strings.ToLower(q[:separator])
+	case "id":
+		if !strkey.IsValidEd25519PublicKey(q) {
+			return nil, logical.CodedError(404, "not found")
+		}
+		path = "federation/addresses/" + q
+	case "":
+		return errMissingField("type"), nil
+	default:
+		return nil, logical.CodedError(501, "query type not supported: "+d.Get("type").(string))
+	}
+
+	record, err := b.readFederationRecord(ctx, req.Storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, logical.CodedError(404, "not found")
+	}
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+record.AccountName)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index may be stale if an account update failed after it was written
+	if account == nil || account.FederationName == "" ||
+		(path != "federation/names/"+account.FederationName && path != "federation/addresses/"+account.Address) {
+		return nil, logical.CodedError(404, "not found")
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"stellar_address": account.FederationName + "*" + config.FederationDomain,
+			"account_id":      account.Address,
+		},
+	}, nil
+}
+
+// setFederationName gives the account a federation name, or removes it if the name is empty. Names are unique
+// across accounts and case insensitive.
+func (b *backend) setFederationName(ctx context.Context, req *logical.Request, accountName string, account *Account, name string) error {
+	name = strings.ToLower(name)
+	if strings.ContainsAny(name, "*>/ \t") {
+		return logical.CodedError(400, "federation_name must not contain '*', '>', '/' or whitespace")
+	}
+
+	b.federationLock.Lock()
+	defer b.federationLock.Unlock()
+
+	if name != "" {
+		existing, err := b.readFederationRecord(ctx, req.Storage, "federation/names/"+name)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.AccountName != accountName {
+			other, err := b.readVaultAccount(ctx, req, "accounts/"+existing.AccountName)
+			if err != nil {
+				return err
+			}
+			if other != nil && other.FederationName == name {
+				return logical.CodedError(409, fmt.Sprintf("federation_name %s is already used by account %s", name, existing.AccountName))
+			}
+		}
+	}
+
+	if account.FederationName != "" && account.FederationName != name {
+		if err := req.Storage.Delete(ctx, "federation/names/"+account.FederationName); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		if err := req.Storage.Delete(ctx, "federation/addresses/"+account.Address); err != nil {
+			return err
+		}
+	} else {
+		record := &FederationRecord{AccountName: accountName}
+		for _, path := range []string{"federation/names/" + name, "federation/addresses/" + account.Address} {
+			entry, err := logical.StorageEntryJSON(path, record)
+			if err != nil {
+				return err
+			}
+			if err := req.Storage.Put(ctx, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	account.FederationName = name
+	return nil
+}
+
+func (b *backend) readFederationRecord(ctx context.Context, s logical.Storage, path string) (*FederationRecord, error) {
+	entry, err := s.Get(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federation record")
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var record FederationRecord
+	if err := entry.DecodeJSON(&record); err != nil {
+		return nil, fmt.Errorf("failed to deserialize federation record")
+	}
+	return &record, nil
+}
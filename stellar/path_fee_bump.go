@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+	"time"
+)
+
+// FeeBudget is the total of the fees an account has paid for fee bump transactions on a day
+type FeeBudget struct {
+	Day   string `json:"day"` // UTC date, YYYY-MM-DD
+	Spent int64  `json:"spent"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func feeBumpPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "transactions/fee_bump",
+			HelpSynopsis: "Wrap a signed transaction in a fee bump transaction paid for by a Vault account",
+			Fields: map[string]*framework.FieldSchema{
+				"transaction": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Base64 encoded signed inner transaction envelope",
+				},
+				"feeAccount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Account paying the fee",
+				},
+				"max_fee": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Base fee per operation to bid in stroops, overriding the configured fee",
+				},
+				"idempotency_key": idempotencyKeyField(),
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.createFeeBump),
+				logical.UpdateOperation: b.idempotent(b.createFeeBump),
+			},
+		},
+	}
+}
+
+// Creates a fee bump transaction signed by the fee account.
+func (b *backend) createFeeBump(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	innerTxBase64 := d.Get("transaction").(string)
+	if innerTxBase64 == "" {
+		return errMissingField("transaction"), nil
+	}
+
+	feeAccountName := d.Get("feeAccount").(string)
+	if feeAccountName == "" {
+		return errMissingField("feeAccount"), nil
+	}
+
+	genericTx, err := txnbuild.TransactionFromXDR(innerTxBase64)
+	if err != nil {
+		return nil, logical.CodedError(400, "transaction is not a valid transaction envelope")
+	}
+	innerTx, ok := genericTx.Transaction()
+	if !ok {
+		return nil, logical.CodedError(400, "transaction is already a fee bump transaction")
+	}
+	if len(innerTx.Signatures()) == 0 {
+		return nil, logical.CodedError(400, "transaction must be signed")
+	}
+
+	// Read optional fields. The fee bump must bid at least the base fee of the inner transaction.
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	baseFee, err := b.chooseBaseFee(config, int64(d.Get("max_fee").(int)))
+	if err != nil {
+		return nil, err
+	}
+	if baseFee < innerTx.BaseFee() {
+		baseFee = innerTx.BaseFee()
+	}
+
+	// Retrieve the fee account keypair from vault storage
+	feeAccount, err := b.readVaultAccount(ctx, req, "accounts/"+feeAccountName)
+	if err != nil {
+		return nil, err
+	}
+	if feeAccount == nil {
+		return nil, logical.CodedError(400, "fee account not found")
+	}
+
+	feeBumpTx, err := txnbuild.NewFeeBumpTransaction(
+		txnbuild.FeeBumpTransactionParams{
+			Inner:      innerTx,
+			FeeAccount: feeAccount.Address,
+			BaseFee:    baseFee,
+		},
+	)
+	if err != nil {
+		return nil, logical.CodedError(400, errors.Wrap(err, "failed to build fee bump transaction").Error())
+	}
+
+	if feeAccount.FeeBumpMaxFee > 0 && feeBumpTx.MaxFee() > feeAccount.FeeBumpMaxFee {
+		return nil, logical.CodedError(403, fmt.Sprintf("fee (%d) is larger than the maximum fee of the fee account (%d)", feeBumpTx.MaxFee(), feeAccount.FeeBumpMaxFee))
+	}
+
+	// The fee account only needs to meet its low threshold
+	signers, explanation, err := b.selectSignersForThresholds(map[string]thresholdLevel{feeAccount.Address: thresholdLow}, feeAccount)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	var keypairs []*keypair.Full
+	for _, signer := range signers {
+		kp, err := keypair.ParseFull(signer.Seed)
+		if err != nil {
+			return nil, err
+		}
+		keypairs = append(keypairs, kp)
+	}
+
+	// The budget is charged before signing, since we can't know whether the signed transaction is submitted
+	if err := b.chargeFeeBudget(ctx, req, feeAccountName, feeAccount, feeBumpTx.MaxFee()); err != nil {
+		return nil, err
+	}
+
+	signedTx, err := feeBumpTx.Sign(b.networkPassphrase, keypairs...)
+	if err != nil {
+		return nil, err
+	}
+	decisions := []string{fmt.Sprintf("fee %d charged to the daily fee budget", feeBumpTx.MaxFee())}
+	if feeAccount.FeeBumpMaxFee > 0 {
+		decisions = append(decisions, fmt.Sprintf("fee_bump_max_fee %d", feeAccount.FeeBumpMaxFee))
+	}
+	if err := b.auditFeeBump(ctx, req, signedTx, decisions, explanation); err != nil {
+		return nil, err
+	}
+
+	signedTxBase64, err := signedTx.Base64()
+	if err != nil {
+		return nil, err
+	}
+	txHash, err := signedTx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	innerTxHash, err := innerTx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"fee_account":            feeAccount.Address,
+			"fee":                    signedTx.MaxFee(),
+			"base_fee":               signedTx.BaseFee(),
+			"transaction_hash":       txHash,
+			"inner_transaction_hash": innerTxHash,
+			"signed_transaction":     signedTxBase64,
+			"signatures":             explanation,
+		},
+	}, nil
+}
+
+// chargeFeeBudget adds the fee to the fees paid by the account today, failing if it would exceed the daily budget
+func (b *backend) chargeFeeBudget(ctx context.Context, req *logical.Request, accountName string, account *Account, fee int64) error {
+	b.feeBudgetLock.Lock()
+	defer b.feeBudgetLock.Unlock()
+
+	path := "fee_budgets/" + accountName
+	today := time.Now().UTC().Format("2006-01-02")
+
+	budget := &FeeBudget{Day: today}
+	entry, err := req.Storage.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		if err := entry.DecodeJSON(budget); err != nil {
+			return err
+		}
+		if budget.Day != today {
+			budget = &FeeBudget{Day: today}
+		}
+	}
+
+	if account.FeeBumpDailyBudget > 0 && budget.Spent+fee > account.FeeBumpDailyBudget {
+		return logical.CodedError(403, fmt.Sprintf("fee (%d) would exceed the daily fee budget of the fee account (%d of %d spent)", fee, budget.Spent, account.FeeBumpDailyBudget))
+	}
+	budget.Spent += fee
+
+	entry, err = logical.StorageEntryJSON(path, budget)
+	if err != nil {
+		return err
+	}
+	return req.Storage.Put(ctx, entry)
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/price"
+	"github.com/stellar/go/txnbuild"
+)
+
+// Register the callbacks for the paths exposed by these functions
+func liquidityPoolsPaths(b *backend) []*framework.Path {
+	poolFields := func(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+		fields["name"] = &framework.FieldSchema{Type: framework.TypeString}
+		fields["assetA"] = &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "First asset of the pool (native or CODE:ISSUER), which must sort before assetB",
+		}
+		fields["assetB"] = &framework.FieldSchema{
+			Type:        framework.TypeString,
+			Description: "Second asset of the pool (native or CODE:ISSUER)",
+		}
+		return transactionFields(fields)
+	}
+
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/liquidity_pools/trust",
+			HelpSynopsis: "Establish a trustline to the shares of a liquidity pool",
+			Fields: poolFields(map[string]*framework.FieldSchema{
+				"limit": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Trustline limit, use 0 to remove the trustline (defaults to the maximum)",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.trustLiquidityPool),
+				logical.UpdateOperation: b.idempotent(b.trustLiquidityPool),
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/liquidity_pools/deposit",
+			HelpSynopsis: "Deposit assets into a liquidity pool",
+			Fields: poolFields(map[string]*framework.FieldSchema{
+				"maxAmountA": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Maximum amount of assetA to deposit",
+				},
+				"maxAmountB": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Maximum amount of assetB to deposit",
+				},
+				"minPrice": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Minimum price of assetA in terms of assetB",
+				},
+				"maxPrice": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Maximum price of assetA in terms of assetB",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.depositLiquidityPool),
+				logical.UpdateOperation: b.idempotent(b.depositLiquidityPool),
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/liquidity_pools/withdraw",
+			HelpSynopsis: "Withdraw assets from a liquidity pool",
+			Fields: poolFields(map[string]*framework.FieldSchema{
+				"amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Amount of pool shares to redeem",
+				},
+				"minAmountA": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Minimum amount of assetA to receive",
+				},
+				"minAmountB": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Minimum amount of assetB to receive",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.withdrawLiquidityPool),
+				logical.UpdateOperation: b.idempotent(b.withdrawLiquidityPool),
+			},
+		},
+	}
+}
+
+// Creates a signed transaction with a change trust operation for the pool shares of the given asset pair.
+func (b *backend) trustLiquidityPool(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, assetA, assetB, resp, err := b.readPoolRequest(ctx, req, d)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	limit := d.Get("limit").(string)
+	if limit != "" {
+		if value, err := decimal.NewFromString(limit); err != nil || value.IsNegative() {
+			return nil, logical.CodedError(400, "limit is either not a number or is negative")
+		}
+	}
+
+	poolID, err := txnbuild.NewLiquidityPoolId(assetA, assetB)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, &txnbuild.ChangeTrust{
+		Line: txnbuild.LiquidityPoolShareChangeTrustAsset{
+			LiquidityPoolParameters: txnbuild.LiquidityPoolParameters{
+				AssetA: assetA,
+				AssetB: assetB,
+				Fee:    txnbuild.LiquidityPoolFeeV18,
+			},
+		},
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build change trust object")
+	}
+
+	return b.signPoolTransaction(ctx, req, tx, account, poolID)
+}
+
+// Creates a signed transaction with a liquidity pool deposit operation.
+func (b *backend) depositLiquidityPool(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, assetA, assetB, resp, err := b.readPoolRequest(ctx, req, d)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Validate required fields are present
+	var amounts []decimal.Decimal
+	for _, field := range []string{"maxAmountA", "maxAmountB"} {
+		value := d.Get(field).(string)
+		if value == "" {
+			return errMissingField(field), nil
+		}
+		amount, err := decimal.NewFromString(value)
+		if err != nil || !amount.IsPositive() {
+			return nil, logical.CodedError(400, field+" must be a positive number")
+		}
+		amounts = append(amounts, amount)
+	}
+
+	minPriceStr := d.Get("minPrice").(string)
+	if minPriceStr == "" {
+		return errMissingField("minPrice"), nil
+	}
+	minPrice, err := price.Parse(minPriceStr)
+	if err != nil {
+		return nil, logical.CodedError(400, "invalid minPrice")
+	}
+	maxPriceStr := d.Get("maxPrice").(string)
+	if maxPriceStr == "" {
+		return errMissingField("maxPrice"), nil
+	}
+	maxPrice, err := price.Parse(maxPriceStr)
+	if err != nil {
+		return nil, logical.CodedError(400, "invalid maxPrice")
+	}
+	if maxPrice.Cheaper(minPrice) {
+		return nil, logical.CodedError(400, "minPrice must not be larger than maxPrice")
+	}
+
+	// Both deposited amounts leave the account, so each is subject to the spend limit
+	for _, amount := range amounts {
+		if valid, err := b.validSpendLimit(account, amount); !valid {
+			return nil, err
+		}
+	}
+
+	poolID, err := txnbuild.NewLiquidityPoolId(assetA, assetB)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, &txnbuild.LiquidityPoolDeposit{
+		LiquidityPoolID: poolID,
+		MaxAmountA:      amounts[0].String(),
+		MaxAmountB:      amounts[1].String(),
+		MinPrice:        minPrice,
+		MaxPrice:        maxPrice,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build liquidity pool deposit object")
+	}
+
+	return b.signPoolTransaction(ctx, req, tx, account, poolID)
+}
+
+// Creates a signed transaction with a liquidity pool withdraw operation.
+func (b *backend) withdrawLiquidityPool(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, assetA, assetB, resp, err := b.readPoolRequest(ctx, req, d)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	// Validate required fields are present
+	var amounts []decimal.Decimal
+	for _, field := range []string{"amount", "minAmountA", "minAmountB"} {
+		value := d.Get(field).(string)
+		if value == "" {
+			return errMissingField(field), nil
+		}
+		amount, err := decimal.NewFromString(value)
+		if err != nil || amount.IsNegative() {
+			return nil, logical.CodedError(400, field+" is either not a number or is negative")
+		}
+		amounts = append(amounts, amount)
+	}
+
+	poolID, err := txnbuild.NewLiquidityPoolId(assetA, assetB)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, &txnbuild.LiquidityPoolWithdraw{
+		LiquidityPoolID: poolID,
+		Amount:          amounts[0].String(),
+		MinAmountA:      amounts[1].String(),
+		MinAmountB:      amounts[2].String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build liquidity pool withdraw object")
+	}
+
+	return b.signPoolTransaction(ctx, req, tx, account, poolID)
+}
+
+// readPoolRequest reads the account and asset pair common to all liquidity pool requests, returning an error
+// response if the request is invalid or the account may not transact in the pool assets.
+func (b *backend) readPoolRequest(ctx context.Context, req *logical.Request, d *framework.FieldData) (*Account, txnbuild.Asset, txnbuild.Asset, *logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, nil, nil, nil, logical.CodedError(400, err.Error())
+	}
+
+	var assets []txnbuild.Asset
+	for _, field := range []string{"assetA", "assetB"} {
+		value := d.Get(field).(string)
+		if value == "" {
+			return nil, nil, nil, errMissingField(field), nil
+		}
+		asset, err := parseAssetString(value)
+		if err != nil {
+			return nil, nil, nil, nil, logical.CodedError(400, err.Error())
+		}
+		assets = append(assets, asset)
+	}
+	if !assets[0].LessThan(assets[1]) {
+		return nil, nil, nil, nil, logical.CodedError(400, "assetA must sort before assetB")
+	}
+
+	// Retrieve the account keypair from vault storage
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if account == nil {
+		return nil, nil, nil, nil, logical.CodedError(400, "account not found")
+	}
+
+	if valid, err := b.validAssetConstraints(account, assets...); !valid {
+		return nil, nil, nil, nil, logical.CodedError(403, err.Error())
+	}
+
+	return account, assets[0], assets[1], nil, nil
+}
+
+// signPoolTransaction signs the transaction with the account and adds the pool id to the response
+func (b *backend) signPoolTransaction(ctx context.Context, req *logical.Request, tx *txnbuild.Transaction, account *Account, poolID txnbuild.LiquidityPoolId) (*logical.Response, error) {
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, policyDecisions(account), account)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.signedTransactionResponse(signedTx, explanation)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["liquidity_pool_id"] = hex.EncodeToString(poolID[:])
+
+	return resp, nil
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+)
+
+// Prefix of signed messages, so that a message signature can never be a transaction signature (SEP-53)
+const signedMessagePrefix = "Stellar Signed Message:\n"
+
+// Maximum size of a signed message, in bytes
+const maxMessageSize = 10 * 1024
+
+// Register the callbacks for the paths exposed by these functions
+func messagesPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/sign_message",
+			HelpSynopsis: "Sign an arbitrary message with the account key, per SEP-53",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"message": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Message to sign",
+				},
+				"encoding": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Encoding of the message: utf8 (the default) or base64 for binary messages",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.signMessage,
+				logical.UpdateOperation: b.signMessage,
+			},
+		},
+		&framework.Path{
+			Pattern:      "verify",
+			HelpSynopsis: "Verify a SEP-53 message signature against any account address",
+			Fields: map[string]*framework.FieldSchema{
+				"address": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Address of the account which signed the message",
+				},
+				"message": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Message which was signed",
+				},
+				"encoding": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Encoding of the message: utf8 (the default) or base64 for binary messages",
+				},
+				"signature": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Base64 encoded signature",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.verifyMessage,
+				logical.UpdateOperation: b.verifyMessage,
+			},
+		},
+	}
+}
+
+// Signs the hash of the prefixed message with the account key, and records the signature in the audit ledger
+func (b *backend) signMessage(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	message, err := readMessage(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retrieve the account keypair from vault storage
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	kp, err := keypair.ParseFull(account.Seed)
+	if err != nil {
+		return nil, err
+	}
+	hash := messageHash(message)
+	signature, err := kp.Sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	record := &AuditRecord{
+		SourceAddress: account.Address,
+		Accounts:      []string{account.Address},
+		Operations:    []string{fmt.Sprintf("SignMessage sha256=%s (%d bytes)", hex.EncodeToString(hash[:]), len(message))},
+		Signers:       []string{account.Address},
+	}
+	if err := b.storeAuditRecord(ctx, req, record); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"address":      account.Address,
+			"message_hash": hex.EncodeToString(hash[:]),
+			"signature":    base64.StdEncoding.EncodeToString(signature),
+			"audit_id":     record.ID,
+		},
+	}, nil
+}
+
+// Checks that the signature is the address' SEP-53 signature of the message
+func (b *backend) verifyMessage(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	address := d.Get("address").(string)
+	if address == "" {
+		return errMissingField("address"), nil
+	}
+	if !strkey.IsValidEd25519PublicKey(address) {
+		return nil, logical.CodedError(400, "address is not a valid account address")
+	}
+	signatureBase64 := d.Get("signature").(string)
+	if signatureBase64 == "" {
+		return errMissingField("signature"), nil
+	}
+	signature, err := base64.StdEncoding.DecodeString(signatureBase64)
+	if err != nil {
+		return nil, logical.CodedError(400, "signature is not valid base64")
+	}
+	message, err := readMessage(d)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, err := keypair.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	hash := messageHash(message)
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"address":      address,
+			"message_hash": hex.EncodeToString(hash[:]),
+			"valid":        kp.Verify(hash[:], signature) == nil,
+		},
+	}, nil
+}
+
+// readMessage returns the decoded message of the request, refusing empty and oversized messages
+func readMessage(d *framework.FieldData) ([]byte, error) {
+	raw := d.Get("message").(string)
+	if raw == "" {
+		return nil, logical.CodedError(400, "Missing required field 'message'")
+	}
+
+	var message []byte
+	switch d.Get("encoding").(string) {
+	case "", "utf8":
+		message = []byte(raw)
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, logical.CodedError(400, "message is not valid base64")
+		}
+		message = decoded
+	default:
+		return nil, logical.CodedError(400, "encoding must be utf8 or base64")
+	}
+
+	if len(message) > maxMessageSize {
+		return nil, logical.CodedError(400, fmt.Sprintf("message is larger than %d bytes", maxMessageSize))
+	}
+	return message, nil
+}
+
+// messageHash returns the hash a message signature signs
+func messageHash(message []byte) [32]byte {
+	return sha256.Sum256(append([]byte(signedMessagePrefix), message...))
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/xdr"
+	"strconv"
+)
+
+// Register the callbacks for the paths exposed by these functions
+func muxedPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/muxed",
+			HelpSynopsis: "Derive the muxed address (M...) of the account for an id",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"id": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "64-bit unsigned id of the muxed account",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.readMuxedAddress,
+			},
+		},
+		&framework.Path{
+			Pattern:      "addresses/decode",
+			HelpSynopsis: "Decode an account (G...) or muxed account (M...) address",
+			Fields: map[string]*framework.FieldSchema{
+				"address": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Address to decode",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.decodeAddress,
+			},
+		},
+	}
+}
+
+// Returns the muxed address of the account for the id
+func (b *backend) readMuxedAddress(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	idString := d.Get("id").(string)
+	if idString == "" {
+		return errMissingField("id"), nil
+	}
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		return nil, logical.CodedError(400, "id is not a 64-bit unsigned integer")
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	address, err := muxedAddress(account.Address, id)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"muxed_address": address,
+			"account_id":    account.Address,
+			"id":            strconv.FormatUint(id, 10),
+		},
+	}, nil
+}
+
+// Returns the account and muxed id an address stands for
+func (b *backend) decodeAddress(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	address := d.Get("address").(string)
+	if address == "" {
+		return errMissingField("address"), nil
+	}
+
+	if strkey.IsValidEd25519PublicKey(address) {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"type":       "account",
+				"account_id": address,
+			},
+		}, nil
+	}
+
+	muxed, err := xdr.AddressToMuxedAccount(address)
+	if err != nil || muxed.Type != xdr.CryptoKeyTypeKeyTypeMuxedEd25519 {
+		return nil, logical.CodedError(400, "address is neither an account nor a muxed account address")
+	}
+	id, err := muxed.GetId()
+	if err != nil {
+		return nil, err
+	}
+	accountID := muxed.ToAccountId()
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"type":       "muxed_account",
+			"account_id": accountID.Address(),
+			"id":         strconv.FormatUint(id, 10),
+		},
+	}, nil
+}
+
+// muxedAddress returns the muxed address of the account for the id
+func muxedAddress(address string, id uint64) (string, error) {
+	muxed, err := xdr.MuxedAccountFromAccountId(address, id)
+	if err != nil {
+		return "", err
+	}
+	return muxed.GetAddress()
+}
+
+// isMuxedAddress returns whether the address is a muxed account address
+func isMuxedAddress(address string) bool {
+	muxed, err := xdr.AddressToMuxedAccount(address)
+	return err == nil && muxed.Type == xdr.CryptoKeyTypeKeyTypeMuxedEd25519
+}
+
+// baseAddress returns the account address of a muxed address, and any other address unchanged
+func baseAddress(address string) string {
+	if !isMuxedAddress(address) {
+		return address
+	}
+	muxed, _ := xdr.AddressToMuxedAccount(address)
+	accountID := muxed.ToAccountId()
+	return accountID.Address()
+}
+
+// addressListed returns whether the address is in a whitelist or blacklist. Listing an account address covers all
+// of its muxed addresses, while listing a muxed address only covers that one.
+func addressListed(list []string, address string) bool {
+	return contains(list, address) || contains(list, baseAddress(address))
+}
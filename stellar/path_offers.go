@@ -0,0 +1,373 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/price"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+	"strconv"
+	"strings"
+)
+
+// Register the callbacks for the paths exposed by these functions
+func offersPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/offers/?",
+			HelpSynopsis: "List the open DEX offers of a Stellar account, or create or update an offer",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Type of offer: 'sell', 'buy' or 'passive_sell'",
+					Default:     "sell",
+				},
+				"offerId": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Id of the offer to update, omit to create a new offer",
+				},
+				"sellingAssetCode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Code of asset to sell (use 'native' for XLM)",
+				},
+				"sellingAssetIssuer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) If selling a non-native asset, this is the issuer address",
+				},
+				"buyingAssetCode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Code of asset to buy (use 'native' for XLM)",
+				},
+				"buyingAssetIssuer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) If buying a non-native asset, this is the issuer address",
+				},
+				"amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Amount to sell, or to buy for 'buy' offers",
+				},
+				"price": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Price of one unit of selling in terms of buying, or of buying in terms of selling for 'buy' offers",
+				},
+				"referencePrice": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Reference price (buying per selling) used to enforce the account price band",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation:   b.listOffers,
+				logical.CreateOperation: b.idempotent(b.manageOffer),
+				logical.UpdateOperation: b.idempotent(b.manageOffer),
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/offers/" + framework.GenericNameRegex("offer_id"),
+			HelpSynopsis: "Cancel a DEX offer",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name":     &framework.FieldSchema{Type: framework.TypeString},
+				"offer_id": &framework.FieldSchema{Type: framework.TypeString},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.DeleteOperation: b.idempotent(b.cancelOffer),
+			},
+		},
+	}
+}
+
+// Returns the open offers of the account as known by Horizon
+func (b *backend) listOffers(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	offers, err := b.horizon.Offers(horizonclient.OfferRequest{ForAccount: account.Address, Limit: 200})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load offers")
+	}
+
+	var offerIds []string
+	offerInfo := make(map[string]interface{})
+	for _, offer := range offers.Embedded.Records {
+		offerId := strconv.FormatInt(offer.ID, 10)
+		offerIds = append(offerIds, offerId)
+		offerInfo[offerId] = map[string]interface{}{
+			"selling": horizonAssetString(offer.Selling),
+			"buying":  horizonAssetString(offer.Buying),
+			"amount":  offer.Amount,
+			"price":   offer.Price,
+		}
+	}
+	return logical.ListResponseWithInfo(offerIds, offerInfo), nil
+}
+
+// Creates a signed transaction with a manage sell, manage buy or passive sell offer operation.
+func (b *backend) manageOffer(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	offerType := d.Get("type").(string)
+	if offerType != "sell" && offerType != "buy" && offerType != "passive_sell" {
+		return nil, logical.CodedError(400, "type must be one of 'sell', 'buy' or 'passive_sell'")
+	}
+
+	sellingAssetCode := d.Get("sellingAssetCode").(string)
+	if sellingAssetCode == "" {
+		return errMissingField("sellingAssetCode"), nil
+	}
+	buyingAssetCode := d.Get("buyingAssetCode").(string)
+	if buyingAssetCode == "" {
+		return errMissingField("buyingAssetCode"), nil
+	}
+
+	amountStr := d.Get("amount").(string)
+	if amountStr == "" {
+		return errMissingField("amount"), nil
+	}
+	amount, err := decimal.NewFromString(amountStr)
+	if err != nil || !amount.IsPositive() {
+		return nil, logical.CodedError(400, "amount must be a positive number")
+	}
+
+	priceStr := d.Get("price").(string)
+	if priceStr == "" {
+		return errMissingField("price"), nil
+	}
+	offerPrice, err := decimal.NewFromString(priceStr)
+	if err != nil || !offerPrice.IsPositive() {
+		return nil, logical.CodedError(400, "price must be a positive number")
+	}
+	xdrPrice, err := price.Parse(priceStr)
+	if err != nil {
+		return nil, logical.CodedError(400, "price cannot be represented as a Stellar price")
+	}
+
+	// Read optional fields
+	var offerId int64
+	if offerIdStr := d.Get("offerId").(string); offerIdStr != "" {
+		offerId, err = strconv.ParseInt(offerIdStr, 10, 64)
+		if err != nil || offerId <= 0 {
+			return nil, logical.CodedError(400, "invalid offerId")
+		}
+		if offerType == "passive_sell" {
+			return nil, logical.CodedError(400, "passive sell offers are updated as 'sell' offers")
+		}
+	}
+	referencePrice := d.Get("referencePrice").(string)
+
+	selling, err := buildAsset(sellingAssetCode, d.Get("sellingAssetIssuer").(string))
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	buying, err := buildAsset(buyingAssetCode, d.Get("buyingAssetIssuer").(string))
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Retrieve the account keypair from vault storage
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	// Express the offer as a selling amount at a price in buying per selling, which is how the policy is defined
+	sellingAmount := amount
+	sellPrice := offerPrice
+	if offerType == "buy" {
+		sellingAmount = amount.Mul(offerPrice)
+		sellPrice = decimal.New(1, 0).DivRound(offerPrice, 7)
+	}
+	if valid, err := b.validAssetConstraints(account, selling, buying); !valid {
+		return nil, logical.CodedError(403, err.Error())
+	}
+	if valid, err := b.validOfferConstraints(account, selling, buying, sellingAmount, sellPrice, referencePrice); !valid {
+		return nil, logical.CodedError(403, err.Error())
+	}
+
+	var op txnbuild.Operation
+	switch offerType {
+	case "sell":
+		op = &txnbuild.ManageSellOffer{Selling: selling, Buying: buying, Amount: amount.String(), Price: xdrPrice, OfferID: offerId}
+	case "buy":
+		op = &txnbuild.ManageBuyOffer{Selling: selling, Buying: buying, Amount: amount.String(), Price: xdrPrice, OfferID: offerId}
+	case "passive_sell":
+		op = &txnbuild.CreatePassiveSellOffer{Selling: selling, Buying: buying, Amount: amount.String(), Price: xdrPrice}
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, op)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build offer object")
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, policyDecisions(account), account)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.signedTransactionResponse(signedTx, explanation)
+}
+
+// Creates a signed transaction which deletes the given offer.
+func (b *backend) cancelOffer(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	offer, err := b.horizon.OfferDetails(d.Get("offer_id").(string))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load offer")
+	}
+	if offer.Seller != account.Address {
+		return nil, logical.CodedError(400, "offer does not belong to this account")
+	}
+
+	selling, err := buildAsset(horizonAssetCode(offer.Selling), offer.Selling.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	buying, err := buildAsset(horizonAssetCode(offer.Buying), offer.Buying.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	deleteOp, err := txnbuild.DeleteOfferOp(offer.ID)
+	if err != nil {
+		return nil, err
+	}
+	deleteOp.Selling = selling
+	deleteOp.Buying = buying
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, &deleteOp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build offer object")
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, nil, account)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.signedTransactionResponse(signedTx, explanation)
+}
+
+// validOfferConstraints checks the offer against the account's DEX policy (asset pairs, max offer size, price band).
+// The amount is of the selling asset, and prices are in units of buying per unit of selling.
+func (b *backend) validOfferConstraints(account *Account, selling txnbuild.Asset, buying txnbuild.Asset, amount decimal.Decimal, offerPrice decimal.Decimal, referencePrice string) (bool, error) {
+	pair := assetString(selling) + "/" + assetString(buying)
+
+	if len(account.OfferAssetPairs) > 0 && !contains(account.OfferAssetPairs, pair) {
+		return false, fmt.Errorf("%s is not an allowed asset pair", pair)
+	}
+
+	maxOfferAmount, _ := decimal.NewFromString(account.MaxOfferAmount)
+	if maxOfferAmount.IsPositive() && amount.GreaterThan(maxOfferAmount) {
+		return false, fmt.Errorf("offer amount (%s) is larger than the maximum offer amount (%s)", amount.String(), account.MaxOfferAmount)
+	}
+
+	priceBand, _ := decimal.NewFromString(account.OfferPriceBand)
+	if !priceBand.IsPositive() {
+		return true, nil
+	}
+
+	if referencePrice == "" {
+		referencePrice = account.OfferReferencePrices[pair]
+	}
+	if referencePrice == "" {
+		return false, fmt.Errorf("a reference price is required for %s", pair)
+	}
+	reference, err := decimal.NewFromString(referencePrice)
+	if err != nil || !reference.IsPositive() {
+		return false, fmt.Errorf("invalid reference price for %s", pair)
+	}
+
+	deviation := offerPrice.Sub(reference).Abs().Div(reference).Mul(decimal.New(100, 0))
+	if deviation.GreaterThan(priceBand) {
+		return false, fmt.Errorf("offer price (%s) deviates more than %s%% from the reference price (%s)", offerPrice.String(), account.OfferPriceBand, reference.String())
+	}
+
+	return true, nil
+}
+
+// assetString returns 'native' for XLM, otherwise CODE:ISSUER
+func assetString(asset txnbuild.Asset) string {
+	if asset.IsNative() {
+		return "native"
+	}
+	return asset.GetCode() + ":" + asset.GetIssuer()
+}
+
+// horizonAssetCode returns the asset code of a Horizon asset, using 'native' for XLM
+func horizonAssetCode(asset hProtocol.Asset) string {
+	if asset.Type == "native" {
+		return "native"
+	}
+	return asset.Code
+}
+
+// horizonAssetString returns 'native' for XLM, otherwise CODE:ISSUER
+func horizonAssetString(asset hProtocol.Asset) string {
+	if asset.Type == "native" {
+		return "native"
+	}
+	return asset.Code + ":" + asset.Issuer
+}
+
+// parseAssetString parses 'native' or CODE:ISSUER into an asset
+func parseAssetString(value string) (txnbuild.Asset, error) {
+	if strings.EqualFold(value, "native") {
+		return txnbuild.NativeAsset{}, nil
+	}
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid asset '%s', expected 'native' or CODE:ISSUER", value)
+	}
+	return buildAsset(parts[0], parts[1])
+}
@@ -22,10 +22,11 @@ import (
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	"github.com/pkg/errors"
-	"github.com/stellar/go/build"
-	"github.com/stellar/go/clients/horizon"
-	"github.com/stellar/go/keypair"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/txnbuild"
 	"math/big"
+	"strconv"
 	"strings"
 )
 
@@ -35,14 +36,18 @@ func paymentsPaths(b *backend) []*framework.Path {
 		&framework.Path{
 			Pattern:      "payments",
 			HelpSynopsis: "Make a payment on the Stellar network",
-			Fields: map[string]*framework.FieldSchema{
+			Fields: transactionFields(map[string]*framework.FieldSchema{
 				"source": &framework.FieldSchema{
 					Type:        framework.TypeString,
 					Description: "Source account",
 				},
 				"destination": &framework.FieldSchema{
 					Type:        framework.TypeString,
-					Description: "Destination account",
+					Description: "Destination Vault account, a federation address (name*domain), or an account or muxed account address if the source account has a whitelist",
+				},
+				"sourceMuxedId": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Id of the muxed address of the source account the payment is sent from",
 				},
 				"paymentChannel": &framework.FieldSchema{
 					Type:        framework.TypeString,
@@ -68,10 +73,26 @@ func paymentsPaths(b *backend) []*framework.Path {
 					Type:        framework.TypeString,
 					Description: "(Optional) An optional memo to include with the payment transaction",
 				},
-			},
+				"memoType": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Type of the memo: text (the default), id or hash (base64)",
+				},
+				"ignoreMemoRequired": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Send the payment without a memo even though the destination requires one (SEP-29)",
+				},
+				"claimableFallback": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) If the destination has no trustline for the asset, create a claimable balance for it instead",
+				},
+				"subaccount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Id of the sub-account of the source to debit the payment from",
+				},
+			}),
 			Callbacks: map[logical.Operation]framework.OperationFunc{
-				logical.CreateOperation: b.createPayment,
-				logical.UpdateOperation: b.createPayment,
+				logical.CreateOperation: b.idempotent(b.createPayment),
+				logical.UpdateOperation: b.idempotent(b.createPayment),
 			},
 		},
 	}
@@ -125,6 +146,15 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 
 	// Read the optional memo field
 	memo := d.Get("memo").(string)
+	memoType := d.Get("memoType").(string)
+
+	// Read the optional claimableFallback field
+	claimableFallback := d.Get("claimableFallback").(bool)
+
+	ignoreMemoRequired := d.Get("ignoreMemoRequired").(bool)
+
+	// Read the optional subaccount field
+	subaccount := d.Get("subaccount").(string)
 
 	// Retrieve the source account keypair from vault storage
 	sourceAccount, err := b.readVaultAccount(ctx, req, "accounts/"+source)
@@ -135,16 +165,41 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 		return nil, logical.CodedError(400, "source account not found")
 	}
 	sourceAddress := sourceAccount.Address
-
-	// Retrieve the destination account keypair from vault storage
-	destinationAccount, err := b.readVaultAccount(ctx, req, "accounts/"+destination)
-	if err != nil {
-		return nil, err
+	if sourceMuxedID := d.Get("sourceMuxedId").(string); sourceMuxedID != "" {
+		id, err := strconv.ParseUint(sourceMuxedID, 10, 64)
+		if err != nil {
+			return nil, logical.CodedError(400, "sourceMuxedId is not a 64-bit unsigned integer")
+		}
+		if sourceAddress, err = muxedAddress(sourceAccount.Address, id); err != nil {
+			return nil, err
+		}
 	}
-	if destinationAccount == nil {
-		return nil, logical.CodedError(400, "destination account not found")
+
+	// Resolve a federation address, otherwise retrieve the destination account keypair from vault storage
+	var destinationAddress string
+	var federationDestination *federationDestination
+	if isFederationAddress(destination) {
+		federationDestination, err = b.resolveFederationAddress(ctx, req.Storage, destination)
+		if err != nil {
+			return nil, err
+		}
+		destinationAddress = federationDestination.AccountID
+	} else if strkey.IsValidEd25519PublicKey(destination) || isMuxedAddress(destination) {
+		// An address may be anyone's, so only accounts restricted to a whitelist may pay one directly
+		if len(sourceAccount.Whitelist) == 0 {
+			return nil, logical.CodedError(403, "only accounts with a whitelist may pay addresses which aren't Vault accounts")
+		}
+		destinationAddress = destination
+	} else {
+		destinationAccount, err := b.readVaultAccount(ctx, req, "accounts/"+destination)
+		if err != nil {
+			return nil, err
+		}
+		if destinationAccount == nil {
+			return nil, logical.CodedError(400, "destination account not found")
+		}
+		destinationAddress = destinationAccount.Address
 	}
-	destinationAddress := destinationAccount.Address
 
 	// If the payment channel account is set, we'll use it, otherwise the source account is to be used
 	var paymentChannelAccount *Account
@@ -162,7 +217,7 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 	paymentChannelAddress := paymentChannelAccount.Address
 
 	// If additionalSigners is set, look up all the keys for these accounts
-	var additionalSignerAccounts []Account
+	var additionalSignerAccounts []*Account
 	for _, additionalSigner := range additionalSigners {
 		additionalSignerAccount, err := b.readVaultAccount(ctx, req, "accounts/"+additionalSigner)
 		if err != nil {
@@ -171,7 +226,7 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 		if additionalSignerAccount == nil {
 			return nil, logical.CodedError(400, "additional signer account not found: "+additionalSigner)
 		}
-		additionalSignerAccounts = append(additionalSignerAccounts, *additionalSignerAccount)
+		additionalSignerAccounts = append(additionalSignerAccounts, additionalSignerAccount)
 	}
 
 	// Validate that this transaction is allowed given the constraints on the source account (whitelist, blacklist, spend limit)
@@ -179,96 +234,181 @@ func (b *backend) createPayment(ctx context.Context, req *logical.Request, d *fr
 		return nil, err
 	}
 
-	// Build the payment object depending on what type of asset we're using
-	var payment build.PaymentBuilder
-	if strings.EqualFold(assetCode, "native") {
-		payment = build.Payment(
-			build.SourceAccount{AddressOrSeed: sourceAddress},
-			build.Destination{AddressOrSeed: destinationAddress},
-			build.NativeAmount{Amount: amount.String()},
-		)
-	} else {
-		// Validate that issuer is a proper stellar address
-		_, err := keypair.Parse(assetIssuer)
-		if err != nil {
-			return nil, logical.CodedError(400, "invalid address for assetIssuer")
+	asset, err := buildAsset(assetCode, assetIssuer)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	if valid, err := b.validAssetConstraints(sourceAccount, asset); !valid {
+		return nil, err
+	}
+
+	// Payouts on behalf of a sub-account are refused if they exceed its virtual balance
+	var debit *SubaccountDebit
+	if subaccount != "" {
+		if subaccount, err = normalizeSubaccountID(subaccount); err != nil {
+			return nil, err
 		}
+		debit = &SubaccountDebit{Account: source, Subaccount: subaccount, Asset: assetString(asset), Amount: amount.String()}
+		if _, err := b.checkSubaccountBalance(ctx, req.Storage, debit); err != nil {
+			return nil, err
+		}
+	}
 
-		payment = build.Payment(
-			build.SourceAccount{AddressOrSeed: sourceAddress},
-			build.Destination{AddressOrSeed: destinationAddress},
-			build.CreditAmount{Code: assetCode, Issuer: assetIssuer, Amount: amount.String()},
-		)
+	// Build the payment operation. If the destination can't receive the asset and the caller asked for it, fall back
+	// to a claimable balance which the destination can claim once it has established a trustline.
+	var payment txnbuild.Operation = &txnbuild.Payment{
+		SourceAccount: sourceAddress,
+		Destination:   destinationAddress,
+		Amount:        amount.String(),
+		Asset:         asset,
+	}
+	if claimableFallback && !asset.IsNative() {
+		hasTrustline, err := b.hasTrustline(baseAddress(destinationAddress), asset)
+		if err != nil {
+			return nil, err
+		}
+		if !hasTrustline {
+			payment = &txnbuild.CreateClaimableBalance{
+				SourceAccount: sourceAddress,
+				Destinations:  []txnbuild.Claimant{txnbuild.NewClaimant(baseAddress(destinationAddress), &txnbuild.UnconditionalPredicate)},
+				Amount:        amount.String(),
+				Asset:         asset,
+			}
+		}
 	}
 
 	// Build the base transaction
-	tx, err := build.Transaction(
-		build.SourceAccount{AddressOrSeed: paymentChannelAddress},
-		build.TestNetwork,
-		build.AutoSequence{SequenceProvider: horizon.DefaultTestNetClient},
-		build.MemoText{Value: memo},
-		payment,
-	)
+	opts, err := b.readTransactionOptions(ctx, req, d)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to build payment object")
+		return nil, err
+	}
+	opts.Memo = memo
+	opts.MemoType = memoType
+	if federationDestination != nil {
+		if err := applyFederationMemo(opts, federationDestination); err != nil {
+			return nil, err
+		}
 	}
 
-	// Build up our array of signer private keys
-	var signers []string
-	signers = append(signers, sourceAccount.Seed)
-	if paymentChannel != "" {
-		signers = append(signers, paymentChannelAccount.Seed)
+	decisions := policyDecisions(sourceAccount)
+	if federationDestination != nil {
+		decisions = append(decisions, fmt.Sprintf("destination %s resolved to %s", destination, destinationAddress))
+	}
+	_, isClaimableBalance := payment.(*txnbuild.CreateClaimableBalance)
+	if isClaimableBalance {
+		decisions = append(decisions, "claimable balance fallback")
+	}
+	if debit != nil {
+		decisions = append(decisions, fmt.Sprintf("debited from sub-account %s", debit.Subaccount))
 	}
 
-	// Stellar currently rejects transactions with more signers than expected based on the account thresholds. So we
-	// comment these signatures for now. https://github.com/stellar/stellar-protocol/issues/120
-	//for _, additionalSigner := range additionalSignerAccounts {
-	//	signers = append(signers, additionalSigner.Seed)
-	//}
+	// Payments without a memo to accounts which require one (e.g. exchange deposit accounts) would be lost. A muxed
+	// destination identifies the recipient instead of a memo.
+	if opts.Memo == "" && !isMuxedAddress(destinationAddress) {
+		required, err := b.memoRequired(destinationAddress)
+		if err != nil {
+			return nil, err
+		}
+		if required && !ignoreMemoRequired {
+			return nil, logical.CodedError(400, fmt.Sprintf("destination %s requires a memo", destinationAddress))
+		}
+		if required {
+			decisions = append(decisions, "memo_required of the destination overridden")
+		}
+	}
 
-	// Sign the transaction with the necessary signatures (source, paymentChannel, additionalSigners)
-	signedTx, err := tx.Sign(signers...)
+	tx, err := b.buildTransaction(paymentChannelAddress, opts, payment)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "failed to build payment object")
 	}
 
-	// Convert to base64
-	signedTxBase64, err := signedTx.Base64()
+	// Large payments are only signed once they have been approved
+	if requiresApproval(sourceAccount, decimal.NewFromBigInt(amount, 0)) {
+		signerNames := []string{source}
+		if paymentChannel != "" {
+			signerNames = append(signerNames, paymentChannel)
+		}
+		signerNames = append(signerNames, additionalSigners...)
+		return b.createApproval(ctx, req, tx, opts, decisions, debit, source, sourceAccount, signerNames)
+	}
+
+	// Sign the transaction with only the signatures needed from the source, paymentChannel and additionalSigners
+	candidates := []*Account{sourceAccount}
+	if paymentChannel != "" {
+		candidates = append(candidates, paymentChannelAccount)
+	}
+	candidates = append(candidates, additionalSignerAccounts...)
+
+	signedTx, explanation, err := b.signDebitedTransaction(ctx, req, tx, decisions, debit, candidates...)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the transaction hash
-	txHash, err := tx.HashHex()
+	resp, err := b.signedTransactionResponse(signedTx, explanation)
 	if err != nil {
 		return nil, err
 	}
+	resp.Data["claimable_balance"] = isClaimableBalance
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"source_address":     tx.TX.SourceAccount.Address(),
-			"account_sequence":   tx.TX.SeqNum,
-			"fee":                tx.TX.Fee,
-			"transaction_hash":   txHash,
-			"signed_transaction": signedTxBase64,
-		},
-	}, nil
+	return resp, nil
 }
 
 func (b *backend) validAccountConstraints(account *Account, amount *big.Int, toAddress string) (bool, error) {
-	txLimit := validNumber(account.TxSpendLimit)
-
-	if txLimit.Cmp(amount) == -1 && txLimit.Cmp(big.NewInt(0)) == 1 {
-		return false, fmt.Errorf("transaction amount (%s) is larger than the transactional limit (%s)", amount.String(), account.TxSpendLimit)
+	if valid, err := b.validSpendLimit(account, decimal.NewFromBigInt(amount, 0)); !valid {
+		return false, err
 	}
 
-	if contains(account.Blacklist, toAddress) {
+	if addressListed(account.Blacklist, toAddress) {
 		return false, fmt.Errorf("%s is blacklisted", toAddress)
 	}
 
-	if len(account.Whitelist) > 0 && !contains(account.Whitelist, toAddress) {
+	if len(account.Whitelist) > 0 && !addressListed(account.Whitelist, toAddress) {
 		return false, fmt.Errorf("%s is not in the whitelist", toAddress)
 	}
 
 	return true, nil
 }
+
+// validFunding verifies that the funding account may pay the starting balance of a new account, which like any
+// payment from it is subject to its spend limit, lists and allowed assets
+func (b *backend) validFunding(funding *Account, address string, startingBalance decimal.Decimal) error {
+	if valid, err := b.validSpendLimit(funding, startingBalance); !valid {
+		return logical.CodedError(403, err.Error())
+	}
+	if addressListed(funding.Blacklist, address) {
+		return logical.CodedError(403, fmt.Sprintf("%s is blacklisted", address))
+	}
+	if len(funding.Whitelist) > 0 && !addressListed(funding.Whitelist, address) {
+		return logical.CodedError(403, fmt.Sprintf("%s is not in the whitelist", address))
+	}
+	if valid, err := b.validAssetConstraints(funding, txnbuild.NativeAsset{}); !valid {
+		return logical.CodedError(403, err.Error())
+	}
+	return nil
+}
+
+// validSpendLimit verifies that the amount doesn't exceed the transactional limit of the account
+func (b *backend) validSpendLimit(account *Account, amount decimal.Decimal) (bool, error) {
+	txLimit, _ := decimal.NewFromString(account.TxSpendLimit)
+
+	if txLimit.IsPositive() && amount.GreaterThan(txLimit) {
+		return false, fmt.Errorf("transaction amount (%s) is larger than the transactional limit (%s)", amount.String(), account.TxSpendLimit)
+	}
+
+	return true, nil
+}
+
+// validAssetConstraints verifies that the account is allowed to transact in the given assets
+func (b *backend) validAssetConstraints(account *Account, assets ...txnbuild.Asset) (bool, error) {
+	if len(account.AllowedAssets) == 0 {
+		return true, nil
+	}
+
+	for _, asset := range assets {
+		if !contains(account.AllowedAssets, assetString(asset)) {
+			return false, fmt.Errorf("%s is not an allowed asset", assetString(asset))
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,355 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/txnbuild"
+)
+
+// Role is a template for the accounts created with role=<name> and issued by creds/<role>
+type Role struct {
+	FundingAccount  string            `json:"funding_account"`  // Name of the Vault account which funds new accounts
+	StartingBalance string            `json:"starting_balance"` // XLM sent to each new account
+	TTL             int               `json:"ttl"`              // Seconds, 0 uses the mount default
+	MaxTTL          int               `json:"max_ttl"`          // Seconds, 0 uses the mount default
+	MaxLeases       int               `json:"max_leases"`       // Accounts issued at once, 0 for no limit
+	TxSpendLimit    string            `json:"tx_spend_limit"`
+	Whitelist       []string          `json:"whitelist"`
+	Blacklist       []string          `json:"blacklist"`
+	AllowedAssets   []string          `json:"allowed_assets"`
+	Flags           []string          `json:"flags"` // Account flags set on new accounts
+	Metadata        map[string]string `json:"metadata"`
+}
+
+// Account flags a role may set, by name
+var accountFlags = map[string]txnbuild.AccountFlag{
+	"auth_required":         txnbuild.AuthRequired,
+	"auth_revocable":        txnbuild.AuthRevocable,
+	"auth_immutable":        txnbuild.AuthImmutable,
+	"auth_clawback_enabled": txnbuild.AuthClawbackEnabled,
+}
+
+// Register the callbacks for the paths exposed by these functions
+func rolesPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "roles/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listRoles,
+			},
+		},
+		&framework.Path{
+			Pattern:      "roles/" + framework.GenericNameRegex("name"),
+			HelpSynopsis: "Manage the account templates applied by role=<name> and creds/<role>",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"funding_account": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Vault account which funds new accounts, and receives the balance of issued accounts back when they expire",
+				},
+				"starting_balance": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Starting balance of XLM of the issued accounts",
+					Default:     "2",
+				},
+				"ttl": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Lease duration of the issued accounts",
+				},
+				"max_ttl": &framework.FieldSchema{
+					Type:        framework.TypeDurationSecond,
+					Description: "(Optional) Maximum lease duration of the issued accounts, including renewals",
+				},
+				"max_leases": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Maximum number of accounts issued from the role at once, 0 for no limit",
+				},
+				"tx_spend_limit": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum amount of tokens which can be sent in a single transaction",
+					Default:     "0",
+				},
+				"whitelist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts (or federation addresses) that the issued accounts can transact with.",
+				},
+				"blacklist": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of accounts (or federation addresses) that the issued accounts are forbidden from transacting with.",
+				},
+				"allowed_assets": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) The list of assets (native or CODE:ISSUER) the issued accounts may transact in.",
+				},
+				"flags": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) Account flags set on new accounts: auth_required, auth_revocable, auth_immutable or auth_clawback_enabled",
+				},
+				"metadata": &framework.FieldSchema{
+					Type:        framework.TypeKVPairs,
+					Description: "(Optional) Free form key/value metadata copied to new accounts",
+				},
+				"propagate": &framework.FieldSchema{
+					Type:        framework.TypeBool,
+					Description: "(Optional) Apply the policies and metadata of the role to the existing accounts created from it",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.writeRole,
+				logical.UpdateOperation: b.writeRole,
+				logical.ReadOperation:   b.readRole,
+				logical.DeleteOperation: b.deleteRole,
+			},
+		},
+	}
+}
+
+// Returns the names of all stored roles
+func (b *backend) listRoles(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(roles), nil
+}
+
+// Creates or replaces a role
+func (b *backend) writeRole(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	roleName := d.Get("name").(string)
+	startingBalance, err := decimal.NewFromString(d.Get("starting_balance").(string))
+	if err != nil || !startingBalance.IsPositive() {
+		return nil, logical.CodedError(400, "starting_balance is either not a number or is not positive")
+	}
+	txSpendLimit, err := decimal.NewFromString(d.Get("tx_spend_limit").(string))
+	if err != nil || txSpendLimit.IsNegative() {
+		return nil, logical.CodedError(400, "tx_spend_limit is either not a number or is negative")
+	}
+
+	role := &Role{
+		FundingAccount:  d.Get("funding_account").(string),
+		StartingBalance: startingBalance.String(),
+		TTL:             d.Get("ttl").(int),
+		MaxTTL:          d.Get("max_ttl").(int),
+		MaxLeases:       d.Get("max_leases").(int),
+		TxSpendLimit:    txSpendLimit.String(),
+	}
+	if role.MaxTTL > 0 && role.TTL > role.MaxTTL {
+		return nil, logical.CodedError(400, "ttl must not be larger than max_ttl")
+	}
+	if role.MaxLeases < 0 {
+		return nil, logical.CodedError(400, "max_leases must not be negative")
+	}
+
+	// Every issued account is a payment of the starting balance from the funding account
+	if role.FundingAccount != "" {
+		funding, err := b.readVaultAccount(ctx, req, "accounts/"+role.FundingAccount)
+		if err != nil {
+			return nil, err
+		}
+		if funding == nil {
+			return nil, logical.CodedError(400, "funding account not found: "+role.FundingAccount)
+		}
+		if valid, err := b.validSpendLimit(funding, startingBalance); !valid {
+			return nil, logical.CodedError(400, "starting_balance: "+err.Error())
+		}
+	}
+	if whitelistRaw, ok := d.GetOk("whitelist"); ok {
+		role.Whitelist = whitelistRaw.([]string)
+	}
+	if blacklistRaw, ok := d.GetOk("blacklist"); ok {
+		role.Blacklist = blacklistRaw.([]string)
+	}
+	if role.Whitelist, err = b.resolveAddresses(ctx, req.Storage, role.Whitelist); err != nil {
+		return nil, err
+	}
+	if role.Blacklist, err = b.resolveAddresses(ctx, req.Storage, role.Blacklist); err != nil {
+		return nil, err
+	}
+	if allowedAssetsRaw, ok := d.GetOk("allowed_assets"); ok {
+		role.AllowedAssets = allowedAssetsRaw.([]string)
+	}
+	for _, allowedAsset := range role.AllowedAssets {
+		if _, err := parseAssetString(allowedAsset); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+	}
+	if flagsRaw, ok := d.GetOk("flags"); ok {
+		role.Flags = flagsRaw.([]string)
+	}
+	for _, flag := range role.Flags {
+		if _, ok := accountFlags[flag]; !ok {
+			return nil, logical.CodedError(400, "unknown account flag: "+flag)
+		}
+	}
+	if metadataRaw, ok := d.GetOk("metadata"); ok {
+		role.Metadata = metadataRaw.(map[string]string)
+	}
+
+	entry, err := logical.StorageEntryJSON("roles/"+roleName, role)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: roleResponseData(role),
+	}
+	if d.Get("propagate").(bool) {
+		propagated, err := b.propagateRole(ctx, req, roleName, role)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data["propagated_accounts"] = propagated
+	}
+	return resp, nil
+}
+
+// propagateRole applies the policies and metadata of the role to the accounts created from it, replacing any values
+// those accounts were created or updated with. Flags and funding only apply when an account is created.
+func (b *backend) propagateRole(ctx context.Context, req *logical.Request, roleName string, role *Role) ([]string, error) {
+	accountNames, err := req.Storage.List(ctx, "accounts/")
+	if err != nil {
+		return nil, err
+	}
+
+	propagated := []string{}
+	for _, accountName := range accountNames {
+		account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+		if err != nil {
+			return nil, err
+		}
+		if account == nil || account.Role != roleName {
+			continue
+		}
+
+		account.TxSpendLimit = role.TxSpendLimit
+		account.Whitelist = role.Whitelist
+		account.Blacklist = role.Blacklist
+		account.AllowedAssets = role.AllowedAssets
+		account.Metadata = role.Metadata
+
+		entry, err := logical.StorageEntryJSON("accounts/"+accountName, account)
+		if err != nil {
+			return nil, err
+		}
+		if err := req.Storage.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+		propagated = append(propagated, accountName)
+	}
+	return propagated, nil
+}
+
+// setAccountFlags submits a set options operation setting the given flags on a new account
+func (b *backend) setAccountFlags(ctx context.Context, req *logical.Request, account *Account, flags []string) error {
+	if len(flags) == 0 {
+		return nil
+	}
+
+	var setFlags []txnbuild.AccountFlag
+	for _, flag := range flags {
+		setFlags = append(setFlags, accountFlags[flag])
+	}
+
+	opts, err := b.defaultTransactionOptions(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	tx, err := b.buildTransaction(account.Address, opts, &txnbuild.SetOptions{SetFlags: setFlags})
+	if err != nil {
+		return errors.Wrap(err, "failed to build set options object")
+	}
+	signedTx, _, err := b.signTransaction(ctx, req, tx, nil, account)
+	if err != nil {
+		return err
+	}
+	if _, err := b.horizon.SubmitTransaction(signedTx); err != nil {
+		return logical.CodedError(400, "failed to set account flags: "+errorString(err))
+	}
+	return nil
+}
+
+// Returns the details of a role
+func (b *backend) readRole(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	role, err := b.readStoredRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: roleResponseData(role),
+	}, nil
+}
+
+// Deletes a role. Accounts already issued from it are revoked when their leases end.
+func (b *backend) deleteRole(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, "roles/"+d.Get("name").(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (b *backend) readStoredRole(ctx context.Context, s logical.Storage, name string) (*Role, error) {
+	entry, err := s.Get(ctx, "roles/"+name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read role %s", name)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var role Role
+	if err := entry.DecodeJSON(&role); err != nil {
+		return nil, fmt.Errorf("failed to deserialize role %s", name)
+	}
+	return &role, nil
+}
+
+// roleResponseData returns the details of a role
+func roleResponseData(role *Role) map[string]interface{} {
+	return map[string]interface{}{
+		"funding_account":  role.FundingAccount,
+		"starting_balance": role.StartingBalance,
+		"ttl":              role.TTL,
+		"max_ttl":          role.MaxTTL,
+		"max_leases":       role.MaxLeases,
+		"tx_spend_limit":   role.TxSpendLimit,
+		"whitelist":        role.Whitelist,
+		"blacklist":        role.Blacklist,
+		"allowed_assets":   role.AllowedAssets,
+		"flags":            role.Flags,
+		"metadata":         role.Metadata,
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/txnbuild"
+	"time"
+)
+
+// Challenges issued slightly in the future by a server whose clock is ahead of ours are still accepted
+const sep10ClockSkew = 5 * time.Minute
+
+// Register the callbacks for the paths exposed by these functions
+func sep10Paths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/sep10",
+			HelpSynopsis: "Sign a SEP-10 web authentication challenge with the account key",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"transaction": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Base64 encoded challenge transaction envelope issued by the server",
+				},
+				"server_key": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "SIGNING_KEY of the server, as published in its stellar.toml",
+				},
+				"home_domain": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Home domain the challenge must have been issued for",
+				},
+				"web_auth_domain": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Domain of the web auth endpoint which issued the challenge",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.signChallenge,
+				logical.UpdateOperation: b.signChallenge,
+			},
+		},
+	}
+}
+
+// Validates a SEP-10 challenge transaction and signs it with the account key. A challenge can't move funds: its
+// sequence number is zero, so it can never be included in a ledger, and it may only contain manage data operations.
+func (b *backend) signChallenge(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	challengeBase64 := d.Get("transaction").(string)
+	if challengeBase64 == "" {
+		return errMissingField("transaction"), nil
+	}
+	serverKey := d.Get("server_key").(string)
+	if serverKey == "" {
+		return errMissingField("server_key"), nil
+	}
+	if !strkey.IsValidEd25519PublicKey(serverKey) {
+		return nil, logical.CodedError(400, "server_key is not a valid account address")
+	}
+	homeDomain := d.Get("home_domain").(string)
+	if homeDomain == "" {
+		return errMissingField("home_domain"), nil
+	}
+	webAuthDomain := d.Get("web_auth_domain").(string)
+	if webAuthDomain == "" {
+		return errMissingField("web_auth_domain"), nil
+	}
+
+	// Retrieve the account keypair from vault storage
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	genericTx, err := txnbuild.TransactionFromXDR(challengeBase64)
+	if err != nil {
+		return nil, logical.CodedError(400, "transaction is not a valid transaction envelope")
+	}
+	challenge, ok := genericTx.Transaction()
+	if !ok {
+		return nil, logical.CodedError(400, "challenge must not be a fee bump transaction")
+	}
+	if err := b.validateChallenge(challenge, account.Address, serverKey, homeDomain, webAuthDomain); err != nil {
+		return nil, logical.CodedError(400, "invalid challenge: "+err.Error())
+	}
+
+	// The challenge is signed with the account key itself, which is what the server verifies against
+	kp, err := keypair.ParseFull(account.Seed)
+	if err != nil {
+		return nil, err
+	}
+	signedTx, err := challenge.Sign(b.networkPassphrase, kp)
+	if err != nil {
+		return nil, err
+	}
+	decisions := []string{fmt.Sprintf("SEP-10 challenge from %s for %s", serverKey, homeDomain)}
+	explanation := &SignatureExplanation{Signers: []SignerUsage{{Address: account.Address}}}
+	if err := b.auditTransaction(ctx, req, signedTx, decisions, explanation); err != nil {
+		return nil, err
+	}
+
+	signedTxBase64, err := signedTx.Base64()
+	if err != nil {
+		return nil, err
+	}
+	txHash, err := signedTx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"account_id":         account.Address,
+			"transaction_hash":   txHash,
+			"signed_transaction": signedTxBase64,
+			"max_time":           signedTx.Timebounds().MaxTime,
+		},
+	}, nil
+}
+
+// validateChallenge checks the challenge against SEP-10: it is issued by the server with a zero sequence number, is
+// within its time bounds, carries only manage data operations with the client's nonce first, and is signed by the
+// server.
+func (b *backend) validateChallenge(tx *txnbuild.Transaction, clientAddress, serverKey, homeDomain, webAuthDomain string) error {
+	if tx.SourceAccount().AccountID != serverKey {
+		return fmt.Errorf("source account is not the server account")
+	}
+	if serverKey == clientAddress {
+		return fmt.Errorf("server account must not be the client account")
+	}
+	if tx.SourceAccount().Sequence != 0 {
+		return fmt.Errorf("sequence number must be zero")
+	}
+
+	switch tx.Memo().(type) {
+	case nil, txnbuild.MemoID:
+	default:
+		return fmt.Errorf("memo must be empty or an id")
+	}
+
+	bounds := tx.Timebounds()
+	if bounds.MinTime == 0 || bounds.MaxTime == 0 {
+		return fmt.Errorf("time bounds must be set")
+	}
+	now := time.Now()
+	if now.Add(sep10ClockSkew).Before(time.Unix(bounds.MinTime, 0)) || now.After(time.Unix(bounds.MaxTime, 0)) {
+		return fmt.Errorf("challenge is outside its time bounds")
+	}
+
+	ops := tx.Operations()
+	if len(ops) == 0 {
+		return fmt.Errorf("challenge has no operations")
+	}
+	for i, op := range ops {
+		manageData, ok := op.(*txnbuild.ManageData)
+		if !ok {
+			return fmt.Errorf("operation %d is not a manage data operation", i)
+		}
+		if manageData.SourceAccount == "" {
+			return fmt.Errorf("operation %d has no source account", i)
+		}
+
+		if i == 0 {
+			// The nonce: 48 random bytes, base64 encoded to 64
+			if manageData.SourceAccount != clientAddress {
+				return fmt.Errorf("first operation is not for account %s", clientAddress)
+			}
+			if manageData.Name != homeDomain+" auth" {
+				return fmt.Errorf("first operation is not for home domain %s", homeDomain)
+			}
+			nonce, err := base64.StdEncoding.DecodeString(string(manageData.Value))
+			if len(manageData.Value) != 64 || err != nil || len(nonce) != 48 {
+				return fmt.Errorf("first operation does not hold a valid nonce")
+			}
+			continue
+		}
+
+		// Only the client_domain operation may come from an account other than the server, and never the client
+		if manageData.SourceAccount == clientAddress {
+			return fmt.Errorf("operation %d must not be sourced by the client account", i)
+		}
+		if manageData.SourceAccount != serverKey && manageData.Name != "client_domain" {
+			return fmt.Errorf("operation %d is not sourced by the server account", i)
+		}
+		if manageData.Name == "web_auth_domain" && string(manageData.Value) != webAuthDomain {
+			return fmt.Errorf("web_auth_domain does not match %s", webAuthDomain)
+		}
+	}
+
+	return b.verifySignature(tx, serverKey)
+}
+
+// verifySignature checks that the transaction carries a valid signature of the given key
+func (b *backend) verifySignature(tx *txnbuild.Transaction, address string) error {
+	kp, err := keypair.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+	hash, err := tx.Hash(b.networkPassphrase)
+	if err != nil {
+		return err
+	}
+	for _, signature := range tx.Signatures() {
+		if kp.Verify(hash[:], signature.Signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("transaction is not signed by %s", address)
+}
@@ -0,0 +1,343 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/txnbuild"
+)
+
+// Register the callbacks for the paths exposed by these functions
+func signersPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/signers",
+			HelpSynopsis: "Add, update or remove a signer of a Stellar account",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"signer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "The signer key: a Vault account name or G... address for ed25519, a T... key or hex transaction hash for pre_auth_tx, or a X... key or hex hash for sha256_hash",
+				},
+				"type": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Type of signer: 'ed25519', 'pre_auth_tx' or 'sha256_hash'",
+					Default:     "ed25519",
+				},
+				"weight": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "Weight of the signer (0-255), use 0 to remove the signer",
+				},
+				"additionalSigners": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) Array of additional signers needed to meet the high threshold of the account",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.readSigners,
+				logical.CreateOperation: b.idempotent(b.updateSigner),
+				logical.UpdateOperation: b.idempotent(b.updateSigner),
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/thresholds",
+			HelpSynopsis: "Set the signature thresholds and master key weight of a Stellar account",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"low": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Low threshold (0-255)",
+				},
+				"medium": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Medium threshold (0-255)",
+				},
+				"high": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) High threshold (0-255)",
+				},
+				"master_weight": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Weight of the master key (0-255)",
+				},
+				"additionalSigners": &framework.FieldSchema{
+					Type:        framework.TypeCommaStringSlice,
+					Description: "(Optional) Array of additional signers needed to meet the high threshold of the account",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.readSigners,
+				logical.CreateOperation: b.idempotent(b.updateThresholds),
+				logical.UpdateOperation: b.idempotent(b.updateThresholds),
+			},
+		},
+	}
+}
+
+// Returns the on-chain signers and thresholds of the account
+func (b *backend) readSigners(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, nil
+	}
+
+	horizonAccount, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: account.Address})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load account")
+	}
+
+	var signers []map[string]interface{}
+	for _, signer := range horizonAccount.Signers {
+		signers = append(signers, map[string]interface{}{
+			"key":    signer.Key,
+			"type":   signer.Type,
+			"weight": signer.Weight,
+		})
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"address": account.Address,
+			"signers": signers,
+			"thresholds": map[string]interface{}{
+				"low":    horizonAccount.Thresholds.LowThreshold,
+				"medium": horizonAccount.Thresholds.MedThreshold,
+				"high":   horizonAccount.Thresholds.HighThreshold,
+			},
+		},
+	}, nil
+}
+
+// Builds, signs and submits a set options transaction which adds, updates or removes a signer.
+func (b *backend) updateSigner(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	signer := d.Get("signer").(string)
+	if signer == "" {
+		return errMissingField("signer"), nil
+	}
+	weightRaw, ok := d.GetOk("weight")
+	if !ok {
+		return errMissingField("weight"), nil
+	}
+	weight := weightRaw.(int)
+	if weight < 0 || weight > 255 {
+		return nil, logical.CodedError(400, "weight must be between 0 and 255")
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	signerKey, err := b.signerKey(ctx, req, d.Get("type").(string), signer)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	if signerKey == account.Address {
+		return nil, logical.CodedError(400, "use the thresholds endpoint to change the master key weight")
+	}
+
+	horizonAccount, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: account.Address})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load account")
+	}
+	weights := signerWeights(horizonAccount)
+	weights[signerKey] = int32(weight)
+	if err := checkControllable(weights, signerKey, int32(horizonAccount.Thresholds.HighThreshold)); err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	return b.submitSetOptions(ctx, req, d, account, &txnbuild.SetOptions{
+		Signer: &txnbuild.Signer{Address: signerKey, Weight: txnbuild.Threshold(weight)},
+	})
+}
+
+// Builds, signs and submits a set options transaction which changes the thresholds and master key weight.
+func (b *backend) updateThresholds(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	horizonAccount, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: account.Address})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load account")
+	}
+	weights := signerWeights(horizonAccount)
+	highThreshold := int32(horizonAccount.Thresholds.HighThreshold)
+
+	// Only the thresholds given in the request are changed
+	setOptions := &txnbuild.SetOptions{}
+	for _, field := range []string{"low", "medium", "high", "master_weight"} {
+		raw, ok := d.GetOk(field)
+		if !ok {
+			continue
+		}
+		value := raw.(int)
+		if value < 0 || value > 255 {
+			return nil, logical.CodedError(400, field+" must be between 0 and 255")
+		}
+		threshold := txnbuild.NewThreshold(txnbuild.Threshold(value))
+		switch field {
+		case "low":
+			setOptions.LowThreshold = threshold
+		case "medium":
+			setOptions.MediumThreshold = threshold
+		case "high":
+			setOptions.HighThreshold = threshold
+			highThreshold = int32(value)
+		case "master_weight":
+			setOptions.MasterWeight = threshold
+			weights[account.Address] = int32(value)
+		}
+	}
+	if setOptions.LowThreshold == nil && setOptions.MediumThreshold == nil && setOptions.HighThreshold == nil && setOptions.MasterWeight == nil {
+		return nil, logical.CodedError(400, "at least one of low, medium, high or master_weight is required")
+	}
+
+	if err := checkControllable(weights, "", highThreshold); err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	return b.submitSetOptions(ctx, req, d, account, setOptions)
+}
+
+// submitSetOptions signs the set options operation with enough signers to meet the high threshold and submits it
+func (b *backend) submitSetOptions(ctx context.Context, req *logical.Request, d *framework.FieldData, account *Account, setOptions *txnbuild.SetOptions) (*logical.Response, error) {
+	candidates := []*Account{account}
+	if additionalSignersRaw, ok := d.GetOk("additionalSigners"); ok {
+		for _, additionalSigner := range additionalSignersRaw.([]string) {
+			additionalSignerAccount, err := b.readVaultAccount(ctx, req, "accounts/"+additionalSigner)
+			if err != nil {
+				return nil, err
+			}
+			if additionalSignerAccount == nil {
+				return nil, logical.CodedError(400, "additional signer account not found: "+additionalSigner)
+			}
+			candidates = append(candidates, additionalSignerAccount)
+		}
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts, setOptions)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build set options object")
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, nil, candidates...)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.submitTransaction(signedTx)
+	if err != nil {
+		return nil, err
+	}
+	b.invalidateSigners(account.Address)
+	resp.Data["signatures"] = explanation
+
+	return resp, nil
+}
+
+// signerKey converts the signer given in the request into its strkey representation
+func (b *backend) signerKey(ctx context.Context, req *logical.Request, signerType string, signer string) (string, error) {
+	var versionByte strkey.VersionByte
+	switch signerType {
+	case "ed25519":
+		return b.resolveAddress(ctx, req, signer)
+	case "pre_auth_tx":
+		versionByte = strkey.VersionByteHashTx
+	case "sha256_hash":
+		versionByte = strkey.VersionByteHashX
+	default:
+		return "", fmt.Errorf("type must be one of 'ed25519', 'pre_auth_tx' or 'sha256_hash'")
+	}
+
+	if _, err := strkey.Decode(versionByte, signer); err == nil {
+		return signer, nil
+	}
+	hash, err := hex.DecodeString(signer)
+	if err != nil || len(hash) != 32 {
+		return "", fmt.Errorf("signer must be a strkey or a hex encoded 32 byte hash")
+	}
+	return strkey.Encode(versionByte, hash)
+}
+
+// signerWeights returns the weights of the ed25519 signers of the account, keyed by address
+func signerWeights(account hProtocol.Account) map[string]int32 {
+	weights := make(map[string]int32)
+	for _, signer := range account.Signers {
+		if _, err := keypair.ParseAddress(signer.Key); err == nil {
+			weights[signer.Key] = signer.Weight
+		}
+	}
+	return weights
+}
+
+// checkControllable verifies that the ed25519 signers of an account can still meet its high threshold, so that a
+// change never locks the account. The changed key is only counted if it is an ed25519 key.
+func checkControllable(weights map[string]int32, changedKey string, highThreshold int32) error {
+	var total int32
+	for key, weight := range weights {
+		if key == changedKey {
+			if _, err := keypair.ParseAddress(key); err != nil {
+				continue
+			}
+		}
+		total += weight
+	}
+	if total == 0 || total < highThreshold {
+		return fmt.Errorf("this change would leave the account unable to meet its high threshold (%d)", highThreshold)
+	}
+	return nil
+}
@@ -0,0 +1,519 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+	"strings"
+	"time"
+)
+
+const (
+	sponsorshipAccount   = "account"
+	sponsorshipTrustline = "trustline"
+)
+
+// Sponsorship is a ledger entry whose reserve is paid by a Vault sponsor account
+type Sponsorship struct {
+	ID              string    `json:"id"`
+	Sponsor         string    `json:"sponsor"` // Name of the sponsor account
+	Type            string    `json:"type"`    // account or trustline
+	Account         string    `json:"account"` // Address of the sponsored account, or of the trustline owner
+	Asset           string    `json:"asset"`   // CODE:ISSUER of a sponsored trustline
+	TransactionHash string    `json:"transaction_hash"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func sponsorshipsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/trustlines",
+			HelpSynopsis: "Create or update a trustline, optionally with its reserve sponsored by another Vault account",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"assetCode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Code of the asset to trust",
+				},
+				"assetIssuer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Issuer address of the asset to trust",
+				},
+				"limit": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Maximum amount of the asset the account may hold, defaults to the maximum (0 removes the trustline)",
+				},
+				"sponsor": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Vault account paying the reserve of the trustline",
+				},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.idempotent(b.createTrustline),
+				logical.UpdateOperation: b.idempotent(b.createTrustline),
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/sponsorships/?",
+			HelpSynopsis: "List the ledger entries sponsored by a Vault account",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listSponsorships,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/sponsorships/" + framework.GenericNameRegex("id"),
+			HelpSynopsis: "Read or revoke a sponsorship",
+			Fields: transactionFields(map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"id":   &framework.FieldSchema{Type: framework.TypeString},
+			}),
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.readSponsorship,
+				logical.DeleteOperation: b.idempotent(b.revokeSponsorship),
+			},
+		},
+	}
+}
+
+// Creates and submits a change trust transaction. With a sponsor, the change trust operation is wrapped in
+// begin/end sponsoring future reserves operations so that the sponsor pays the reserve.
+func (b *backend) createTrustline(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	// Validate required fields are present
+	name := d.Get("name").(string)
+	assetCode := d.Get("assetCode").(string)
+	if assetCode == "" {
+		return errMissingField("assetCode"), nil
+	}
+	assetIssuer := d.Get("assetIssuer").(string)
+	if assetIssuer == "" {
+		return errMissingField("assetIssuer"), nil
+	}
+
+	limit := d.Get("limit").(string)
+	removing := false
+	if limit != "" {
+		value, err := decimal.NewFromString(limit)
+		if err != nil || value.IsNegative() {
+			return nil, logical.CodedError(400, "limit is either not a number or is negative")
+		}
+		removing = value.IsZero()
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	asset, err := buildAsset(assetCode, assetIssuer)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	if asset.IsNative() {
+		return nil, logical.CodedError(400, "cannot create a trustline for the native asset")
+	}
+	if valid, err := b.validAssetConstraints(account, asset); !valid {
+		return nil, err
+	}
+	line, err := asset.ToChangeTrustAsset()
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	changeTrust := &txnbuild.ChangeTrust{Line: line, Limit: limit}
+
+	sponsorName := d.Get("sponsor").(string)
+	if removing && sponsorName != "" {
+		return nil, logical.CodedError(400, "a trustline being removed cannot be sponsored")
+	}
+	if sponsorName == "" {
+		tx, err := b.buildTransaction(account.Address, opts, changeTrust)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to build change trust object")
+		}
+		signedTx, explanation, err := b.signTransaction(ctx, req, tx, policyDecisions(account), account)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := b.submitTransaction(signedTx)
+		if err != nil {
+			return nil, err
+		}
+		resp.Data["signatures"] = explanation
+
+		// A removed trustline no longer needs its reserve, so forget whoever sponsored it
+		if removing {
+			if err := b.forgetSponsorships(ctx, req, sponsorshipTrustline, account.Address, assetString(asset)); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
+
+	sponsor, err := b.readVaultAccount(ctx, req, "accounts/"+sponsorName)
+	if err != nil {
+		return nil, err
+	}
+	if sponsor == nil {
+		return nil, logical.CodedError(400, "sponsor account not found")
+	}
+	if sponsor.Address == account.Address {
+		return nil, logical.CodedError(400, "an account cannot sponsor itself")
+	}
+
+	// Hold the lock until the sponsorship is recorded, so that concurrent requests can't exceed the sponsor limit
+	b.sponsorshipLock.Lock()
+	defer b.sponsorshipLock.Unlock()
+
+	if err := b.checkSponsorshipLimit(ctx, req, sponsorName, sponsor); err != nil {
+		return nil, err
+	}
+
+	// Only a new trustline has a reserve to sponsor
+	exists, err := b.hasTrustline(account.Address, asset)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, logical.CodedError(409, "the trustline already exists, update it without a sponsor")
+	}
+
+	tx, err := b.buildTransaction(account.Address, opts,
+		&txnbuild.BeginSponsoringFutureReserves{SponsoredID: account.Address, SourceAccount: sponsor.Address},
+		changeTrust,
+		&txnbuild.EndSponsoringFutureReserves{},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build change trust object")
+	}
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, append(policyDecisions(account), "reserve sponsored by "+sponsorName), account, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.submitTransaction(signedTx)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["signatures"] = explanation
+
+	sponsorship, err := b.recordSponsorship(ctx, req, sponsorName, sponsorshipTrustline, account.Address, assetString(asset), resp.Data["transaction_hash"].(string))
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["sponsorship_id"] = sponsorship.ID
+	return resp, nil
+}
+
+// createSponsoredAccount creates the account on the network with its reserve paid by the sponsor, which also funds
+// the starting balance. The new account doesn't exist yet, so its key signs without looking up its thresholds.
+func (b *backend) createSponsoredAccount(ctx context.Context, req *logical.Request, sponsorName string, sponsor *Account, newAccount *keypair.Full, startingBalance decimal.Decimal) (*Sponsorship, error) {
+	b.sponsorshipLock.Lock()
+	defer b.sponsorshipLock.Unlock()
+
+	if err := b.checkSponsorshipLimit(ctx, req, sponsorName, sponsor); err != nil {
+		return nil, err
+	}
+
+	// The starting balance is a payment from the sponsor, so its policies apply. The transaction is signed with the
+	// new key right away, so a starting balance which needs approval is refused.
+	decisions := append(policyDecisions(sponsor), "reserve sponsored by "+sponsorName)
+	if startingBalance.IsPositive() {
+		if err := b.validFunding(sponsor, newAccount.Address(), startingBalance); err != nil {
+			return nil, err
+		}
+		if requiresApproval(sponsor, startingBalance) {
+			return nil, logical.CodedError(403, "xlm_balance is above the approval_threshold of "+sponsorName)
+		}
+		decisions = append(decisions, fmt.Sprintf("starting balance of %s XLM paid by %s", startingBalance, sponsorName))
+	}
+
+	opts, err := b.defaultTransactionOptions(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(sponsor.Address, opts,
+		&txnbuild.BeginSponsoringFutureReserves{SponsoredID: newAccount.Address()},
+		&txnbuild.CreateAccount{Destination: newAccount.Address(), Amount: startingBalance.String()},
+		&txnbuild.EndSponsoringFutureReserves{SourceAccount: newAccount.Address()},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build create account object")
+	}
+
+	signers, _, err := b.selectSignersForThresholds(map[string]thresholdLevel{sponsor.Address: thresholdMedium}, sponsor)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+	keypairs := []*keypair.Full{newAccount}
+	for _, signer := range signers {
+		kp, err := keypair.ParseFull(signer.Seed)
+		if err != nil {
+			return nil, err
+		}
+		keypairs = append(keypairs, kp)
+	}
+	signedTx, err := tx.Sign(b.networkPassphrase, keypairs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.auditTransaction(ctx, req, signedTx, decisions, nil); err != nil {
+		return nil, err
+	}
+
+	result, err := b.horizon.SubmitTransaction(signedTx)
+	if err != nil {
+		return nil, logical.CodedError(400, "failed to submit transaction: "+errorString(err))
+	}
+
+	return b.recordSponsorship(ctx, req, sponsorName, sponsorshipAccount, newAccount.Address(), "", result.Hash)
+}
+
+// Returns the ids of the sponsorships of the account, with what each sponsors
+func (b *backend) listSponsorships(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	sponsorName := d.Get("name").(string)
+	ids, err := req.Storage.List(ctx, "sponsorships/"+sponsorName+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	sponsorshipInfo := make(map[string]interface{})
+	for _, id := range ids {
+		sponsorship, err := b.readStoredSponsorship(ctx, req, sponsorName, id)
+		if err != nil {
+			return nil, err
+		}
+		if sponsorship == nil {
+			continue
+		}
+		sponsorshipInfo[id] = map[string]interface{}{
+			"type":    sponsorship.Type,
+			"account": sponsorship.Account,
+			"asset":   sponsorship.Asset,
+		}
+	}
+	return logical.ListResponseWithInfo(ids, sponsorshipInfo), nil
+}
+
+// Returns the details of a sponsorship
+func (b *backend) readSponsorship(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	sponsorship, err := b.readStoredSponsorship(ctx, req, d.Get("name").(string), d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if sponsorship == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: sponsorshipResponseData(sponsorship),
+	}, nil
+}
+
+// Submits a revoke sponsorship operation, which moves the reserve of the entry back to the sponsored account
+func (b *backend) revokeSponsorship(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	sponsorName := d.Get("name").(string)
+
+	b.sponsorshipLock.Lock()
+	defer b.sponsorshipLock.Unlock()
+
+	sponsorship, err := b.readStoredSponsorship(ctx, req, sponsorName, d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	if sponsorship == nil {
+		return nil, logical.CodedError(404, "sponsorship not found")
+	}
+
+	sponsor, err := b.readVaultAccount(ctx, req, "accounts/"+sponsorName)
+	if err != nil {
+		return nil, err
+	}
+	if sponsor == nil {
+		return nil, logical.CodedError(404, "account not found")
+	}
+
+	revoke := &txnbuild.RevokeSponsorship{}
+	switch sponsorship.Type {
+	case sponsorshipAccount:
+		revoke.SponsorshipType = txnbuild.RevokeSponsorshipTypeAccount
+		revoke.Account = &sponsorship.Account
+	case sponsorshipTrustline:
+		asset, err := parseAssetString(sponsorship.Asset)
+		if err != nil {
+			return nil, err
+		}
+		trustLineAsset, err := asset.ToTrustLineAsset()
+		if err != nil {
+			return nil, err
+		}
+		revoke.SponsorshipType = txnbuild.RevokeSponsorshipTypeTrustLine
+		revoke.TrustLine = &txnbuild.TrustLineID{Account: sponsorship.Account, Asset: trustLineAsset}
+	default:
+		return nil, fmt.Errorf("unknown sponsorship type %s", sponsorship.Type)
+	}
+
+	opts, err := b.readTransactionOptions(ctx, req, d)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := b.buildTransaction(sponsor.Address, opts, revoke)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build revoke sponsorship object")
+	}
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, nil, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.submitTransaction(signedTx)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data["signatures"] = explanation
+
+	if err := req.Storage.Delete(ctx, "sponsorships/"+sponsorName+"/"+sponsorship.ID); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkSponsorshipLimit fails if the sponsor already sponsors as many entries as its limit allows
+func (b *backend) checkSponsorshipLimit(ctx context.Context, req *logical.Request, sponsorName string, sponsor *Account) error {
+	if sponsor.SponsorshipLimit <= 0 {
+		return nil
+	}
+	ids, err := req.Storage.List(ctx, "sponsorships/"+sponsorName+"/")
+	if err != nil {
+		return err
+	}
+	if len(ids) >= sponsor.SponsorshipLimit {
+		return logical.CodedError(403, fmt.Sprintf("sponsor account already sponsors its limit of %d entries", sponsor.SponsorshipLimit))
+	}
+	return nil
+}
+
+// forgetSponsorships deletes the recorded sponsorships, by any sponsor, of a ledger entry which no longer exists
+func (b *backend) forgetSponsorships(ctx context.Context, req *logical.Request, sponsorshipType string, account string, asset string) error {
+	sponsors, err := req.Storage.List(ctx, "sponsorships/")
+	if err != nil {
+		return err
+	}
+	for _, sponsor := range sponsors {
+		sponsorName := strings.TrimSuffix(sponsor, "/")
+		ids, err := req.Storage.List(ctx, "sponsorships/"+sponsorName+"/")
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			sponsorship, err := b.readStoredSponsorship(ctx, req, sponsorName, id)
+			if err != nil {
+				return err
+			}
+			if sponsorship != nil && sponsorship.Type == sponsorshipType && sponsorship.Account == account && sponsorship.Asset == asset {
+				if err := req.Storage.Delete(ctx, "sponsorships/"+sponsorName+"/"+id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) recordSponsorship(ctx context.Context, req *logical.Request, sponsorName string, sponsorshipType string, account string, asset string, txHash string) (*Sponsorship, error) {
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	sponsorship := &Sponsorship{
+		ID:              id,
+		Sponsor:         sponsorName,
+		Type:            sponsorshipType,
+		Account:         account,
+		Asset:           asset,
+		TransactionHash: txHash,
+		CreatedAt:       time.Now().UTC(),
+	}
+
+	entry, err := logical.StorageEntryJSON("sponsorships/"+sponsorName+"/"+id, sponsorship)
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+	return sponsorship, nil
+}
+
+func (b *backend) readStoredSponsorship(ctx context.Context, req *logical.Request, sponsorName string, id string) (*Sponsorship, error) {
+	entry, err := req.Storage.Get(ctx, "sponsorships/"+sponsorName+"/"+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sponsorship %s", id)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var sponsorship Sponsorship
+	if err := entry.DecodeJSON(&sponsorship); err != nil {
+		return nil, fmt.Errorf("failed to deserialize sponsorship %s", id)
+	}
+	return &sponsorship, nil
+}
+
+// sponsorshipResponseData returns the details of a sponsorship
+func sponsorshipResponseData(sponsorship *Sponsorship) map[string]interface{} {
+	data := map[string]interface{}{
+		"sponsorship_id":   sponsorship.ID,
+		"sponsor":          sponsorship.Sponsor,
+		"type":             sponsorship.Type,
+		"account":          sponsorship.Account,
+		"transaction_hash": sponsorship.TransactionHash,
+		"created_at":       sponsorship.CreatedAt,
+	}
+	if sponsorship.Asset != "" {
+		data["asset"] = sponsorship.Asset
+	}
+	return data
+}
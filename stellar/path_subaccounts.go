@@ -0,0 +1,560 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/protocols/horizon/operations"
+	"github.com/stellar/go/txnbuild"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Number of payments loaded from Horizon per page when crediting sub-accounts
+const subaccountSyncPageSize = 200
+
+// Subaccount is a virtual balance held by a customer inside a custodial Vault account. Incoming payments carrying
+// the id of the sub-account as their memo, or sent to the muxed address of the account with that id, are credited to
+// it, and payments made on its behalf are debited from it.
+type Subaccount struct {
+	ID        string            `json:"id"`
+	Balances  map[string]string `json:"balances"` // Keyed by asset (native or CODE:ISSUER)
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// SubaccountDebit is a payment to be debited from a sub-account once it is signed
+type SubaccountDebit struct {
+	Account    string `json:"account"` // Name of the Vault account holding the sub-account
+	Subaccount string `json:"subaccount"`
+	Asset      string `json:"asset"`
+	Amount     string `json:"amount"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func subaccountsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "accounts/" + framework.GenericNameRegex("name") + "/subaccounts/?",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listSubaccounts,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/subaccounts/sync",
+			HelpSynopsis: "Credit the incoming payments of the account to its sub-accounts",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.syncSubaccountsPath,
+				logical.UpdateOperation: b.syncSubaccountsPath,
+			},
+		},
+		&framework.Path{
+			Pattern:      "accounts/" + framework.GenericNameRegex("name") + "/subaccounts/(?P<id>[0-9]+)",
+			HelpSynopsis: "Manage the virtual balances of customers inside a custodial account",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"id": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "64-bit unsigned id of the sub-account, used as the memo or muxed id of its deposits",
+				},
+			},
+			ExistenceCheck: b.subaccountExistenceCheck,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.createSubaccount,
+				logical.ReadOperation:   b.readSubaccount,
+				logical.DeleteOperation: b.deleteSubaccount,
+			},
+		},
+	}
+}
+
+// Returns the ids of the sub-accounts of the account
+func (b *backend) listSubaccounts(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	ids, err := req.Storage.List(ctx, "subaccounts/"+d.Get("name").(string)+"/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(ids), nil
+}
+
+// Writes to an existing sub-account are updates, which are refused so that balances are only changed by payments
+func (b *backend) subaccountExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	id, err := normalizeSubaccountID(d.Get("id").(string))
+	if err != nil {
+		return false, nil
+	}
+	subaccount, err := b.readStoredSubaccount(ctx, req.Storage, d.Get("name").(string), id)
+	if err != nil {
+		return false, err
+	}
+	return subaccount != nil, nil
+}
+
+// Creates an empty sub-account. The first sub-account of an account starts crediting its payments from now on.
+func (b *backend) createSubaccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accountName := d.Get("name").(string)
+	id, err := normalizeSubaccountID(d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	b.subaccountLock.Lock()
+	defer b.subaccountLock.Unlock()
+
+	cursor, err := b.readSubaccountCursor(ctx, req.Storage, accountName)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == "" {
+		if cursor, err = b.latestPaymentCursor(account.Address); err != nil {
+			return nil, err
+		}
+		if err := b.storeSubaccountCursor(ctx, req.Storage, accountName, cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC()
+	subaccount := &Subaccount{ID: id, Balances: map[string]string{}, CreatedAt: now, UpdatedAt: now}
+	if err := b.storeSubaccount(ctx, req.Storage, accountName, subaccount); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: subaccountResponseData(account, subaccount),
+	}, nil
+}
+
+// Returns the balances of a sub-account
+func (b *backend) readSubaccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accountName := d.Get("name").(string)
+	id, err := normalizeSubaccountID(d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+	subaccount, err := b.readStoredSubaccount(ctx, req.Storage, accountName, id)
+	if err != nil {
+		return nil, err
+	}
+	if subaccount == nil {
+		return nil, nil
+	}
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "account not found")
+	}
+
+	return &logical.Response{
+		Data: subaccountResponseData(account, subaccount),
+	}, nil
+}
+
+// Deletes a sub-account, which must be empty
+func (b *backend) deleteSubaccount(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	accountName := d.Get("name").(string)
+	id, err := normalizeSubaccountID(d.Get("id").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	b.subaccountLock.Lock()
+	defer b.subaccountLock.Unlock()
+
+	subaccount, err := b.readStoredSubaccount(ctx, req.Storage, accountName, id)
+	if err != nil {
+		return nil, err
+	}
+	if subaccount == nil {
+		return nil, nil
+	}
+	for asset, balance := range subaccount.Balances {
+		if amount, _ := decimal.NewFromString(balance); !amount.IsZero() {
+			return nil, logical.CodedError(409, fmt.Sprintf("sub-account still holds %s %s", balance, asset))
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, "subaccounts/"+accountName+"/"+id); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Credits the incoming payments of the account received since the last sync
+func (b *backend) syncSubaccountsPath(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	credited, unmatched, err := b.syncSubaccounts(ctx, req, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"credited":  credited,
+			"unmatched": unmatched,
+		},
+	}, nil
+}
+
+// syncSubaccounts credits the payments the account received since the last sync to the sub-accounts they are for.
+// Payments which don't match a sub-account are left uncredited.
+func (b *backend) syncSubaccounts(ctx context.Context, req *logical.Request, accountName string) (int, int, error) {
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+accountName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if account == nil {
+		return 0, 0, logical.CodedError(400, "account not found")
+	}
+
+	b.subaccountLock.Lock()
+	defer b.subaccountLock.Unlock()
+
+	cursor, err := b.readSubaccountCursor(ctx, req.Storage, accountName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cursor == "" {
+		// No sub-accounts have been created yet
+		return 0, 0, nil
+	}
+
+	credited, unmatched := 0, 0
+	for {
+		page, err := b.horizon.Payments(horizonclient.OperationRequest{
+			ForAccount: account.Address,
+			Cursor:     cursor,
+			Order:      horizonclient.OrderAsc,
+			Limit:      subaccountSyncPageSize,
+			Join:       "transactions",
+		})
+		if err != nil {
+			return credited, unmatched, errors.Wrap(err, "failed to load payments of "+account.Address)
+		}
+
+		for _, record := range page.Embedded.Records {
+			cursor = record.PagingToken()
+			payment, ok := receivedPayment(record)
+			if ok && payment.From == account.Address && baseAddress(payment.To) != account.Address {
+				// Outgoing payments were debited when they were signed
+				continue
+			}
+			if !ok || !payment.TransactionSuccessful || baseAddress(payment.To) != account.Address {
+				log.Printf("%s %s of %s is not a payment that can be credited", record.GetType(), record.GetID(), accountName)
+				unmatched++
+				continue
+			}
+
+			id := subaccountIDOf(payment)
+			subaccount, err := b.readStoredSubaccount(ctx, req.Storage, accountName, id)
+			if err != nil {
+				return credited, unmatched, err
+			}
+			if id == "" || subaccount == nil {
+				log.Printf("payment %s to %s matches no sub-account", payment.ID, accountName)
+				unmatched++
+				continue
+			}
+
+			asset := "native"
+			if payment.Asset.Type != "native" {
+				asset = payment.Asset.Code + ":" + payment.Asset.Issuer
+			}
+			amount, err := decimal.NewFromString(payment.Amount)
+			if err != nil {
+				return credited, unmatched, err
+			}
+			balance, _ := decimal.NewFromString(subaccount.Balances[asset])
+			subaccount.Balances[asset] = balance.Add(amount).String()
+			subaccount.UpdatedAt = time.Now().UTC()
+			if err := b.storeSubaccount(ctx, req.Storage, accountName, subaccount); err != nil {
+				return credited, unmatched, err
+			}
+			credited++
+		}
+
+		// Store the cursor after each page, so that no payment is credited twice
+		if err := b.storeSubaccountCursor(ctx, req.Storage, accountName, cursor); err != nil {
+			return credited, unmatched, err
+		}
+		if len(page.Embedded.Records) < subaccountSyncPageSize {
+			return credited, unmatched, nil
+		}
+	}
+}
+
+// syncAllSubaccounts credits the incoming payments of every account with sub-accounts
+func (b *backend) syncAllSubaccounts(ctx context.Context, req *logical.Request) error {
+	accountNames, err := req.Storage.List(ctx, "subaccount_cursors/")
+	if err != nil {
+		return err
+	}
+	for _, accountName := range accountNames {
+		if _, _, err := b.syncSubaccounts(ctx, req, accountName); err != nil {
+			log.Printf("failed to sync sub-accounts of %s: %v", accountName, err)
+		}
+	}
+	return nil
+}
+
+// receivedPayment returns the payment a record makes, with the amount and asset received for path payments
+func receivedPayment(record operations.Operation) (operations.Payment, bool) {
+	switch op := record.(type) {
+	case operations.Payment:
+		return op, true
+	case operations.PathPayment:
+		return op.Payment, true
+	case operations.PathPaymentStrictSend:
+		return op.Payment, true
+	}
+	return operations.Payment{}, false
+}
+
+// subaccountIDOf returns the sub-account a payment is for: the id of its muxed destination, otherwise its id or
+// numeric text memo
+func subaccountIDOf(payment operations.Payment) string {
+	if payment.ToMuxed != "" {
+		return strconv.FormatUint(payment.ToMuxedID, 10)
+	}
+	if payment.Transaction == nil {
+		return ""
+	}
+	switch payment.Transaction.MemoType {
+	case "id", "text":
+		if id, err := normalizeSubaccountID(payment.Transaction.Memo); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// normalizeSubaccountID returns the canonical form of a sub-account id, so that ids such as 007 and 7 are the same
+// sub-account
+func normalizeSubaccountID(id string) (string, error) {
+	parsed, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return "", logical.CodedError(400, "sub-account id is not a 64-bit unsigned integer: "+id)
+	}
+	return strconv.FormatUint(parsed, 10), nil
+}
+
+// latestPaymentCursor returns the paging token of the latest payment of the account, so that crediting starts after it
+func (b *backend) latestPaymentCursor(address string) (string, error) {
+	page, err := b.horizon.Payments(horizonclient.OperationRequest{
+		ForAccount: address,
+		Order:      horizonclient.OrderDesc,
+		Limit:      1,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to load payments of "+address)
+	}
+	if len(page.Embedded.Records) == 0 {
+		// Payments are credited from the first one
+		return "0", nil
+	}
+	return page.Embedded.Records[0].PagingToken(), nil
+}
+
+// checkSubaccountBalance fails if the sub-account can't cover the debit
+func (b *backend) checkSubaccountBalance(ctx context.Context, s logical.Storage, debit *SubaccountDebit) (*Subaccount, error) {
+	subaccount, err := b.readStoredSubaccount(ctx, s, debit.Account, debit.Subaccount)
+	if err != nil {
+		return nil, err
+	}
+	if subaccount == nil {
+		return nil, logical.CodedError(400, "sub-account not found: "+debit.Subaccount)
+	}
+
+	amount, err := decimal.NewFromString(debit.Amount)
+	if err != nil {
+		return nil, err
+	}
+	balance, _ := decimal.NewFromString(subaccount.Balances[debit.Asset])
+	if amount.GreaterThan(balance) {
+		return nil, logical.CodedError(403, fmt.Sprintf("payment amount (%s) is larger than the balance of sub-account %s (%s %s)", debit.Amount, debit.Subaccount, balance.String(), debit.Asset))
+	}
+	return subaccount, nil
+}
+
+// signDebitedTransaction signs a payment made on behalf of a sub-account, if any. The sub-account is debited when the
+// transaction is signed, and the debit is tied to the transaction hash so that it is refunded if the transaction
+// fails or expires.
+func (b *backend) signDebitedTransaction(ctx context.Context, req *logical.Request, tx *txnbuild.Transaction, decisions []string, debit *SubaccountDebit, candidates ...*Account) (*txnbuild.Transaction, *SignatureExplanation, error) {
+	if debit == nil {
+		return b.signTransaction(ctx, req, tx, decisions, candidates...)
+	}
+
+	if err := b.applySubaccountDebit(ctx, req.Storage, debit, false); err != nil {
+		return nil, nil, err
+	}
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, decisions, candidates...)
+	if err == nil {
+		var hash string
+		if hash, err = signedTx.HashHex(b.networkPassphrase); err == nil {
+			var entry *logical.StorageEntry
+			if entry, err = logical.StorageEntryJSON("subaccount_debits/"+hash, debit); err == nil {
+				err = req.Storage.Put(ctx, entry)
+			}
+		}
+	}
+	if err != nil {
+		if refundErr := b.applySubaccountDebit(ctx, req.Storage, debit, true); refundErr != nil {
+			return nil, nil, errors.Wrap(refundErr, "failed to refund sub-account after signing failed: "+err.Error())
+		}
+		return nil, nil, err
+	}
+	return signedTx, explanation, nil
+}
+
+// settleSubaccountDebit refunds the sub-account debit of a transaction which failed or expired, and forgets the
+// debit once the transaction is final
+func (b *backend) settleSubaccountDebit(ctx context.Context, s logical.Storage, status *TransactionStatus) error {
+	if status.Status == txStatusPending {
+		return nil
+	}
+	entry, err := s.Get(ctx, "subaccount_debits/"+status.TransactionHash)
+	if err != nil {
+		return fmt.Errorf("failed to read sub-account debit of transaction %s", status.TransactionHash)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil
+	}
+
+	if status.Status == txStatusFailed || status.Status == txStatusExpired {
+		var debit SubaccountDebit
+		if err := entry.DecodeJSON(&debit); err != nil {
+			return fmt.Errorf("failed to deserialize sub-account debit of transaction %s", status.TransactionHash)
+		}
+		if err := b.applySubaccountDebit(ctx, s, &debit, true); err != nil {
+			return err
+		}
+		log.Printf("refunded %s %s to sub-account %s of %s, transaction %s %s", debit.Amount, debit.Asset, debit.Subaccount, debit.Account, status.TransactionHash, status.Status)
+	}
+	return s.Delete(ctx, "subaccount_debits/"+status.TransactionHash)
+}
+
+// applySubaccountDebit debits the sub-account, failing if its balance doesn't cover the debit. With refund set it
+// credits back a debit whose transaction could not be signed.
+func (b *backend) applySubaccountDebit(ctx context.Context, s logical.Storage, debit *SubaccountDebit, refund bool) error {
+	b.subaccountLock.Lock()
+	defer b.subaccountLock.Unlock()
+
+	amount, err := decimal.NewFromString(debit.Amount)
+	if err != nil {
+		return err
+	}
+
+	var subaccount *Subaccount
+	if refund {
+		subaccount, err = b.readStoredSubaccount(ctx, s, debit.Account, debit.Subaccount)
+		if err != nil || subaccount == nil {
+			return err
+		}
+		amount = amount.Neg()
+	} else if subaccount, err = b.checkSubaccountBalance(ctx, s, debit); err != nil {
+		return err
+	}
+
+	balance, _ := decimal.NewFromString(subaccount.Balances[debit.Asset])
+	subaccount.Balances[debit.Asset] = balance.Sub(amount).String()
+	subaccount.UpdatedAt = time.Now().UTC()
+	return b.storeSubaccount(ctx, s, debit.Account, subaccount)
+}
+
+func (b *backend) storeSubaccount(ctx context.Context, s logical.Storage, accountName string, subaccount *Subaccount) error {
+	entry, err := logical.StorageEntryJSON("subaccounts/"+accountName+"/"+subaccount.ID, subaccount)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) readStoredSubaccount(ctx context.Context, s logical.Storage, accountName, id string) (*Subaccount, error) {
+	if id == "" {
+		return nil, nil
+	}
+	entry, err := s.Get(ctx, "subaccounts/"+accountName+"/"+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sub-account %s of %s", id, accountName)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var subaccount Subaccount
+	if err := entry.DecodeJSON(&subaccount); err != nil {
+		return nil, fmt.Errorf("failed to deserialize sub-account %s of %s", id, accountName)
+	}
+	if subaccount.Balances == nil {
+		subaccount.Balances = map[string]string{}
+	}
+	return &subaccount, nil
+}
+
+func (b *backend) storeSubaccountCursor(ctx context.Context, s logical.Storage, accountName, cursor string) error {
+	return s.Put(ctx, &logical.StorageEntry{Key: "subaccount_cursors/" + accountName, Value: []byte(cursor)})
+}
+
+func (b *backend) readSubaccountCursor(ctx context.Context, s logical.Storage, accountName string) (string, error) {
+	entry, err := s.Get(ctx, "subaccount_cursors/"+accountName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read payment cursor of %s", accountName)
+	}
+	if entry == nil {
+		return "", nil
+	}
+	return string(entry.Value), nil
+}
+
+// subaccountResponseData returns the details of a sub-account, with the muxed address its deposits can be sent to
+func subaccountResponseData(account *Account, subaccount *Subaccount) map[string]interface{} {
+	data := map[string]interface{}{
+		"id":         subaccount.ID,
+		"account_id": account.Address,
+		"memo":       subaccount.ID,
+		"balances":   subaccount.Balances,
+		"created_at": subaccount.CreatedAt,
+		"updated_at": subaccount.UpdatedAt,
+	}
+	if id, err := strconv.ParseUint(subaccount.ID, 10, 64); err == nil {
+		if address, err := muxedAddress(account.Address, id); err == nil {
+			data["muxed_address"] = address
+		}
+	}
+	return data
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/xdr"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	txStatusPending = "pending"
+	txStatusSuccess = "success"
+	txStatusFailed  = "failed"
+	txStatusExpired = "expired"
+)
+
+// A transaction may still be included in a ledger closing shortly after its max time, so give it some slack
+const txExpiryGrace = 30 * time.Second
+
+// Maximum number of pending transactions checked against Horizon in one reconciliation pass
+const maxReconciledTransactions = 100
+
+// TransactionStatus is the on-chain status of a signed transaction, as last checked against Horizon
+type TransactionStatus struct {
+	TransactionHash string    `json:"transaction_hash"`
+	AuditID         string    `json:"audit_id"` // Id of the audit record of the transaction
+	Status          string    `json:"status"`
+	Ledger          int32     `json:"ledger"`
+	ResultCode      string    `json:"result_code"`
+	OperationCodes  []string  `json:"operation_codes"`
+	MaxTime         int64     `json:"max_time"`
+	CheckedAt       time.Time `json:"checked_at"`
+}
+
+// Register the callbacks for the paths exposed by these functions
+func transactionsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			// Only hex hashes match, so that transactions/fee_bump is not shadowed
+			Pattern:      "transactions/(?P<hash>[0-9a-fA-F]{64})",
+			HelpSynopsis: "Look up the record and on-chain status of a signed transaction",
+			Fields: map[string]*framework.FieldSchema{
+				"hash": &framework.FieldSchema{Type: framework.TypeString},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.readTransactionStatus,
+			},
+		},
+	}
+}
+
+// Returns the audit record of the transaction together with its current on-chain status
+func (b *backend) readTransactionStatus(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	hash := strings.ToLower(d.Get("hash").(string))
+
+	status, err := b.readStoredTransactionStatus(ctx, req.Storage, hash)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		return nil, logical.CodedError(404, "transaction was not signed by this backend")
+	}
+
+	if status.Status == txStatusPending {
+		if err := b.checkTransactionStatus(status); err != nil {
+			return nil, err
+		}
+		if err := b.settleSubaccountDebit(ctx, req.Storage, status); err != nil {
+			return nil, err
+		}
+		if err := b.storeTransactionStatus(ctx, req.Storage, status); err != nil {
+			return nil, err
+		}
+	}
+
+	data := transactionStatusResponseData(status)
+	record, err := b.readStoredAuditRecord(ctx, req.Storage, status.AuditID)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		data["record"] = auditRecordResponseData(record)
+	}
+
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// checkTransactionStatus updates the status of a pending transaction from Horizon
+func (b *backend) checkTransactionStatus(status *TransactionStatus) error {
+	status.CheckedAt = time.Now().UTC()
+
+	tx, err := b.horizon.TransactionDetail(status.TransactionHash)
+	if err != nil {
+		if herr, ok := err.(*horizonclient.Error); ok && herr.Problem.Status == http.StatusNotFound {
+			// Not in a ledger (yet). Once past its time bounds it never will be.
+			if status.MaxTime > 0 && time.Now().After(time.Unix(status.MaxTime, 0).Add(txExpiryGrace)) {
+				status.Status = txStatusExpired
+			}
+			return nil
+		}
+		return errors.Wrap(err, "failed to load transaction "+status.TransactionHash)
+	}
+
+	status.Ledger = tx.Ledger
+	if tx.Successful {
+		status.Status = txStatusSuccess
+		return nil
+	}
+
+	status.Status = txStatusFailed
+	var result xdr.TransactionResult
+	if err := xdr.SafeUnmarshalBase64(tx.ResultXdr, &result); err != nil {
+		return nil
+	}
+	status.ResultCode = result.Result.Code.String()
+	if opResults, ok := result.OperationResults(); ok {
+		status.OperationCodes = nil
+		for _, opResult := range opResults {
+			status.OperationCodes = append(status.OperationCodes, operationResultCode(opResult))
+		}
+	}
+	return nil
+}
+
+// operationResultCode returns the result code of an operation, from the result of the operation type if it failed
+func operationResultCode(r xdr.OperationResult) string {
+	if r.Code != xdr.OperationResultCodeOpInner || r.Tr == nil {
+		return r.Code.String()
+	}
+	switch tr := *r.Tr; tr.Type {
+	case xdr.OperationTypePayment:
+		return tr.PaymentResult.Code.String()
+	case xdr.OperationTypeCreateAccount:
+		return tr.CreateAccountResult.Code.String()
+	case xdr.OperationTypeAccountMerge:
+		return tr.AccountMergeResult.Code.String()
+	case xdr.OperationTypeChangeTrust:
+		return tr.ChangeTrustResult.Code.String()
+	case xdr.OperationTypeManageSellOffer:
+		return tr.ManageSellOfferResult.Code.String()
+	case xdr.OperationTypeManageBuyOffer:
+		return tr.ManageBuyOfferResult.Code.String()
+	case xdr.OperationTypeCreateClaimableBalance:
+		return tr.CreateClaimableBalanceResult.Code.String()
+	default:
+		return tr.Type.String()
+	}
+}
+
+// reconcileTransactions updates the stored status of pending transactions
+func (b *backend) reconcileTransactions(ctx context.Context, s logical.Storage) error {
+	hashes, err := s.List(ctx, "transaction_status/")
+	if err != nil {
+		return err
+	}
+
+	checked := 0
+	for _, hash := range hashes {
+		if checked >= maxReconciledTransactions {
+			break
+		}
+
+		status, err := b.readStoredTransactionStatus(ctx, s, hash)
+		if err != nil {
+			return err
+		}
+		if status == nil || status.Status != txStatusPending {
+			continue
+		}
+
+		checked++
+		if err := b.checkTransactionStatus(status); err != nil {
+			log.Printf("failed to reconcile transaction %s: %v", hash, err)
+			continue
+		}
+		if err := b.settleSubaccountDebit(ctx, s, status); err != nil {
+			return err
+		}
+		if err := b.storeTransactionStatus(ctx, s, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneTransactionStatuses deletes the statuses of transactions which have been final for longer than the
+// configured retention, so that reconciliation doesn't read them forever
+func (b *backend) pruneTransactionStatuses(ctx context.Context, s logical.Storage) error {
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-time.Duration(config.TransactionStatusRetention) * time.Second)
+
+	hashes, err := s.List(ctx, "transaction_status/")
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		status, err := b.readStoredTransactionStatus(ctx, s, hash)
+		if err != nil {
+			return err
+		}
+		if status != nil && status.Status != txStatusPending && status.CheckedAt.Before(cutoff) {
+			if err := s.Delete(ctx, "transaction_status/"+hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *backend) storeTransactionStatus(ctx context.Context, s logical.Storage, status *TransactionStatus) error {
+	entry, err := logical.StorageEntryJSON("transaction_status/"+status.TransactionHash, status)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) readStoredTransactionStatus(ctx context.Context, s logical.Storage, hash string) (*TransactionStatus, error) {
+	entry, err := s.Get(ctx, "transaction_status/"+hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status of transaction %s", hash)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var status TransactionStatus
+	if err := entry.DecodeJSON(&status); err != nil {
+		return nil, fmt.Errorf("failed to deserialize status of transaction %s", hash)
+	}
+	return &status, nil
+}
+
+// transactionStatusResponseData returns the on-chain status of a transaction
+func transactionStatusResponseData(status *TransactionStatus) map[string]interface{} {
+	data := map[string]interface{}{
+		"transaction_hash": status.TransactionHash,
+		"status":           status.Status,
+		"max_time":         status.MaxTime,
+		"checked_at":       status.CheckedAt,
+	}
+	if status.Ledger > 0 {
+		data["ledger"] = status.Ledger
+	}
+	if status.Status == txStatusFailed {
+		data["result_code"] = status.ResultCode
+		data["operation_codes"] = status.OperationCodes
+	}
+	return data
+}
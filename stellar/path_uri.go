@@ -0,0 +1,524 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/clients/stellartoml"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/network"
+	"github.com/stellar/go/txnbuild"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const sep7Scheme = "web+stellar:"
+
+// SEP-7 memo types, and the memo types of the payments path they map to
+var sep7MemoTypes = map[string]string{
+	"MEMO_TEXT": "text",
+	"MEMO_ID":   "id",
+	"MEMO_HASH": "hash",
+}
+
+// stellarTomlResolver fetches the stellar.toml of a domain, which publishes the key its SEP-7 URIs are signed with
+type stellarTomlResolver interface {
+	GetStellarToml(domain string) (*stellartoml.Response, error)
+}
+
+// Register the callbacks for the paths exposed by these functions
+func uriPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern:      "uri/pay",
+			HelpSynopsis: "Generate a signed SEP-7 web+stellar:pay URI requesting a payment to a Vault account",
+			Fields: map[string]*framework.FieldSchema{
+				"destination": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Account to be paid",
+				},
+				"amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Amount requested, left to the payer otherwise",
+				},
+				"assetCode": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Code of the asset requested, XLM otherwise",
+				},
+				"assetIssuer": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Issuer of the asset requested",
+				},
+				"memo": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Memo the payment must carry",
+				},
+				"memoType": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Type of the memo: text (the default), id or hash (base64)",
+				},
+				"msg": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Message shown to the payer",
+				},
+				"callback": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) URL the signed transaction is posted to instead of being submitted",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.createPayURI,
+				logical.UpdateOperation: b.createPayURI,
+			},
+		},
+		&framework.Path{
+			Pattern:      "uri/parse",
+			HelpSynopsis: "Verify a signed SEP-7 URI and sign the payment or transaction it requests",
+			Fields: map[string]*framework.FieldSchema{
+				"uri": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "web+stellar:pay or web+stellar:tx URI",
+				},
+				"source": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "Account which pays, or signs the transaction",
+				},
+				"amount": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Amount to pay, if the pay URI leaves it to the payer",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.parseURI,
+				logical.UpdateOperation: b.parseURI,
+			},
+		},
+	}
+}
+
+// Builds a web+stellar:pay URI for the account, signed with the configured URI request signing key
+func (b *backend) createPayURI(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	destination := d.Get("destination").(string)
+	if destination == "" {
+		return errMissingField("destination"), nil
+	}
+	destinationAccount, err := b.readVaultAccount(ctx, req, "accounts/"+destination)
+	if err != nil {
+		return nil, err
+	}
+	if destinationAccount == nil {
+		return nil, logical.CodedError(400, "destination account not found")
+	}
+
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config.URISigningAccount == "" || config.URIOriginDomain == "" {
+		return nil, logical.CodedError(400, "uri_signing_account and uri_origin_domain must be configured")
+	}
+	signingAccount, err := b.readVaultAccount(ctx, req, "accounts/"+config.URISigningAccount)
+	if err != nil {
+		return nil, err
+	}
+	if signingAccount == nil {
+		return nil, logical.CodedError(400, "uri signing account not found")
+	}
+
+	params := [][2]string{{"destination", destinationAccount.Address}}
+	if amount := d.Get("amount").(string); amount != "" {
+		if value, err := decimal.NewFromString(amount); err != nil || !value.IsPositive() {
+			return nil, logical.CodedError(400, "amount is either not a number or is not positive")
+		}
+		params = append(params, [2]string{"amount", amount})
+	}
+	if assetCode := d.Get("assetCode").(string); assetCode != "" && !strings.EqualFold(assetCode, "native") {
+		if _, err := buildAsset(assetCode, d.Get("assetIssuer").(string)); err != nil {
+			return nil, logical.CodedError(400, err.Error())
+		}
+		params = append(params, [2]string{"asset_code", assetCode}, [2]string{"asset_issuer", d.Get("assetIssuer").(string)})
+	}
+	if memo := d.Get("memo").(string); memo != "" {
+		memoType := ""
+		for sep7Type, paymentType := range sep7MemoTypes {
+			if paymentType == firstNonEmpty(d.Get("memoType").(string), "text") {
+				memoType = sep7Type
+			}
+		}
+		if memoType == "" {
+			return nil, logical.CodedError(400, "unknown memo type: "+d.Get("memoType").(string))
+		}
+		params = append(params, [2]string{"memo", memo}, [2]string{"memo_type", memoType})
+	}
+	if callback := d.Get("callback").(string); callback != "" {
+		params = append(params, [2]string{"callback", "url:" + callback})
+	}
+	if msg := d.Get("msg").(string); msg != "" {
+		if len(msg) > 300 {
+			return nil, logical.CodedError(400, "msg must be at most 300 characters")
+		}
+		params = append(params, [2]string{"msg", msg})
+	}
+	params = append(params,
+		[2]string{"network_passphrase", b.networkPassphrase},
+		[2]string{"origin_domain", config.URIOriginDomain})
+
+	var query []string
+	for _, param := range params {
+		query = append(query, param[0]+"="+sep7Escape(param[1]))
+	}
+	uri := sep7Scheme + "pay?" + strings.Join(query, "&")
+
+	kp, err := keypair.ParseFull(signingAccount.Seed)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := kp.Sign(sep7Payload(uri))
+	if err != nil {
+		return nil, err
+	}
+	uri += "&signature=" + sep7Escape(base64.StdEncoding.EncodeToString(signature))
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"uri":         uri,
+			"signing_key": signingAccount.Address,
+		},
+	}, nil
+}
+
+// Verifies a SEP-7 URI against the key of its origin domain and signs what it requests. Pay URIs become payments,
+// and tx URIs are signed, under the policies of the source account. Nothing is posted to a callback; it is returned
+// to the caller instead.
+func (b *backend) parseURI(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	uri := d.Get("uri").(string)
+	if uri == "" {
+		return errMissingField("uri"), nil
+	}
+	source := d.Get("source").(string)
+	if source == "" {
+		return errMissingField("source"), nil
+	}
+
+	operation, params, err := b.verifyURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *logical.Response
+	switch operation {
+	case "pay":
+		resp, err = b.payFromURI(ctx, req, source, params, d.Get("amount").(string))
+	case "tx":
+		resp, err = b.signFromURI(ctx, req, source, params)
+	default:
+		return nil, logical.CodedError(400, "unsupported uri operation: "+operation)
+	}
+	if err != nil || resp == nil || resp.IsError() {
+		return resp, err
+	}
+
+	resp.Data["origin_domain"] = params.Get("origin_domain")
+	if msg := params.Get("msg"); msg != "" {
+		resp.Data["msg"] = msg
+	}
+	if callback := params.Get("callback"); callback != "" {
+		resp.Data["callback"] = strings.TrimPrefix(callback, "url:")
+	}
+	return resp, nil
+}
+
+// verifyURI parses a SEP-7 URI and checks that it is signed with the URI_REQUEST_SIGNING_KEY published in the
+// stellar.toml of its origin domain
+func (b *backend) verifyURI(uri string) (string, url.Values, error) {
+	if !strings.HasPrefix(uri, sep7Scheme) {
+		return "", nil, logical.CodedError(400, "uri is not a web+stellar uri")
+	}
+	separator := strings.Index(uri, "?")
+	if separator < 0 {
+		return "", nil, logical.CodedError(400, "uri has no parameters")
+	}
+	operation := uri[len(sep7Scheme):separator]
+	params, err := url.ParseQuery(uri[separator+1:])
+	if err != nil {
+		return "", nil, logical.CodedError(400, "uri parameters are malformed")
+	}
+
+	// URIs without a network passphrase are for the public network
+	if firstNonEmpty(params.Get("network_passphrase"), network.PublicNetworkPassphrase) != b.networkPassphrase {
+		return "", nil, logical.CodedError(400, "uri is for another network")
+	}
+
+	// Only signed URIs are accepted. The signature is the last parameter and signs everything before it.
+	originDomain := params.Get("origin_domain")
+	if originDomain == "" {
+		return "", nil, logical.CodedError(400, "uri has no origin_domain")
+	}
+	signatureIndex := strings.LastIndex(uri, "&signature=")
+	if signatureIndex < 0 || strings.Contains(uri[signatureIndex+1:], "&") {
+		return "", nil, logical.CodedError(400, "uri is not signed")
+	}
+	signature, err := base64.StdEncoding.DecodeString(params.Get("signature"))
+	if err != nil {
+		return "", nil, logical.CodedError(400, "uri signature is malformed")
+	}
+
+	toml, err := b.stellarToml.GetStellarToml(originDomain)
+	if err != nil {
+		return "", nil, logical.CodedError(400, errors.Wrap(err, "failed to load stellar.toml of "+originDomain).Error())
+	}
+	if toml.UriRequestSigningKey == "" {
+		return "", nil, logical.CodedError(400, originDomain+" publishes no URI_REQUEST_SIGNING_KEY")
+	}
+	kp, err := keypair.ParseAddress(toml.UriRequestSigningKey)
+	if err != nil {
+		return "", nil, logical.CodedError(400, "URI_REQUEST_SIGNING_KEY of "+originDomain+" is invalid")
+	}
+	if err := kp.Verify(sep7Payload(uri[:signatureIndex]), signature); err != nil {
+		return "", nil, logical.CodedError(403, "uri signature does not match the key of "+originDomain)
+	}
+
+	return operation, params, nil
+}
+
+// payFromURI makes the payment a pay URI requests, through the payments path so that its policies apply
+func (b *backend) payFromURI(ctx context.Context, req *logical.Request, source string, params url.Values, amount string) (*logical.Response, error) {
+	if params.Get("amount") != "" {
+		if amount != "" && amount != params.Get("amount") {
+			return nil, logical.CodedError(400, "amount conflicts with the amount of the uri")
+		}
+		amount = params.Get("amount")
+	}
+	if amount == "" {
+		return errMissingField("amount"), nil
+	}
+
+	raw := map[string]interface{}{
+		"source":      source,
+		"destination": params.Get("destination"),
+		"amount":      amount,
+		"assetCode":   firstNonEmpty(params.Get("asset_code"), "native"),
+	}
+	if issuer := params.Get("asset_issuer"); issuer != "" {
+		raw["assetIssuer"] = issuer
+	}
+	if memo := params.Get("memo"); memo != "" {
+		memoType, ok := sep7MemoTypes[firstNonEmpty(params.Get("memo_type"), "MEMO_TEXT")]
+		if !ok {
+			return nil, logical.CodedError(400, "unsupported memo type: "+params.Get("memo_type"))
+		}
+		raw["memo"] = memo
+		raw["memoType"] = memoType
+	}
+
+	paymentReq := *req
+	paymentReq.Data = raw
+	return b.createPayment(ctx, &paymentReq, &framework.FieldData{
+		Raw:    raw,
+		Schema: paymentsPaths(b)[0].Fields,
+	})
+}
+
+// signFromURI signs the transaction a tx URI requests with the source account, if the transaction only contains
+// operations its policies can be checked against
+func (b *backend) signFromURI(ctx context.Context, req *logical.Request, source string, params url.Values) (*logical.Response, error) {
+	if params.Get("replace") != "" {
+		return nil, logical.CodedError(400, "uris with field replacements are not supported")
+	}
+
+	account, err := b.readVaultAccount(ctx, req, "accounts/"+source)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		return nil, logical.CodedError(400, "source account not found")
+	}
+	if pubkey := params.Get("pubkey"); pubkey != "" && pubkey != account.Address {
+		return nil, logical.CodedError(400, "uri must be signed by "+pubkey)
+	}
+
+	genericTx, err := txnbuild.TransactionFromXDR(params.Get("xdr"))
+	if err != nil {
+		return nil, logical.CodedError(400, "xdr is not a valid transaction envelope")
+	}
+	tx, ok := genericTx.Transaction()
+	if !ok {
+		return nil, logical.CodedError(400, "fee bump transactions are not supported")
+	}
+	totals, err := b.validSigningRequest(account, tx)
+	if err != nil {
+		return nil, err
+	}
+	decisions := append(policyDecisions(account), "SEP-7 uri from "+params.Get("origin_domain"))
+
+	// Like payments, transactions sending more than the approval threshold of an asset need a quorum of approvers
+	for _, total := range totals {
+		if requiresApproval(account, total) {
+			opts, err := b.uriTransactionOptions(ctx, req.Storage, tx)
+			if err != nil {
+				return nil, err
+			}
+			return b.createApproval(ctx, req, tx, opts, decisions, nil, source, account, []string{source})
+		}
+	}
+
+	signedTx, explanation, err := b.signTransaction(ctx, req, tx, decisions, account)
+	if err != nil {
+		return nil, err
+	}
+	return b.signedTransactionResponse(signedTx, explanation)
+}
+
+// validSigningRequest checks a transaction from a third party against the policies of the account: it may only
+// contain payments and account creations by the account, to whitelisted destinations and in amounts and assets the
+// account may send. The spend limit applies to the total sent of each asset, which is returned.
+func (b *backend) validSigningRequest(account *Account, tx *txnbuild.Transaction) (map[string]decimal.Decimal, error) {
+	if baseAddress(tx.SourceAccount().AccountID) != account.Address {
+		return nil, logical.CodedError(403, "transaction source account is not "+account.Address)
+	}
+
+	totals := make(map[string]decimal.Decimal)
+	for _, op := range tx.Operations() {
+		if source := op.GetSourceAccount(); source != "" && baseAddress(source) != account.Address {
+			return nil, logical.CodedError(403, "operation source account is not "+account.Address)
+		}
+
+		var destination, amount string
+		var asset txnbuild.Asset
+		switch o := op.(type) {
+		case *txnbuild.Payment:
+			destination, amount, asset = o.Destination, o.Amount, o.Asset
+		case *txnbuild.CreateAccount:
+			destination, amount, asset = o.Destination, o.Amount, txnbuild.NativeAsset{}
+		default:
+			return nil, logical.CodedError(403, operationSummary(op)+" is not allowed in a signing request")
+		}
+
+		value, err := decimal.NewFromString(amount)
+		if err != nil {
+			return nil, logical.CodedError(400, "invalid amount: "+amount)
+		}
+		totals[assetString(asset)] = totals[assetString(asset)].Add(value)
+		if valid, err := b.validSpendLimit(account, totals[assetString(asset)]); !valid {
+			return nil, logical.CodedError(403, err.Error())
+		}
+		if addressListed(account.Blacklist, destination) {
+			return nil, logical.CodedError(403, fmt.Sprintf("%s is blacklisted", destination))
+		}
+		if len(account.Whitelist) == 0 || !addressListed(account.Whitelist, destination) {
+			return nil, logical.CodedError(403, fmt.Sprintf("%s is not in the whitelist", destination))
+		}
+		if valid, err := b.validAssetConstraints(account, asset); !valid {
+			return nil, logical.CodedError(403, err.Error())
+		}
+
+		// Payments without a memo to accounts which require one would be lost (SEP-29)
+		if _, isPayment := op.(*txnbuild.Payment); isPayment && tx.Memo() == nil && !isMuxedAddress(destination) {
+			required, err := b.memoRequired(destination)
+			if err != nil {
+				return nil, err
+			}
+			if required {
+				return nil, logical.CodedError(400, fmt.Sprintf("destination %s requires a memo", destination))
+			}
+		}
+	}
+	return totals, nil
+}
+
+// uriTransactionOptions returns the options a transaction from a signing request is rebuilt with once approved. Its
+// fee, memo and preconditions are kept, and without an upper time bound it is valid for the configured tx_timeout.
+func (b *backend) uriTransactionOptions(ctx context.Context, s logical.Storage, tx *txnbuild.Transaction) (*transactionOptions, error) {
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	timebounds := tx.Timebounds()
+	opts := &transactionOptions{
+		BaseFee: tx.BaseFee(),
+		Timeout: config.TxTimeout,
+		MinTime: timebounds.MinTime,
+		MaxTime: timebounds.MaxTime,
+	}
+
+	switch memo := tx.Memo().(type) {
+	case nil:
+	case txnbuild.MemoText:
+		opts.Memo, opts.MemoType = string(memo), "text"
+	case txnbuild.MemoID:
+		opts.Memo, opts.MemoType = strconv.FormatUint(uint64(memo), 10), "id"
+	case txnbuild.MemoHash:
+		opts.Memo, opts.MemoType = base64.StdEncoding.EncodeToString(memo[:]), "hash"
+	default:
+		return nil, logical.CodedError(400, "transactions with a return memo can't wait for approval")
+	}
+
+	envelope := tx.ToXDR()
+	if ledgerBounds := envelope.LedgerBounds(); ledgerBounds != nil {
+		opts.MinLedger, opts.MaxLedger = uint32(ledgerBounds.MinLedger), uint32(ledgerBounds.MaxLedger)
+	}
+	opts.MinSequenceNumber = envelope.MinSeqNum()
+	if minSequenceAge := envelope.MinSeqAge(); minSequenceAge != nil {
+		opts.MinSequenceAge = uint64(*minSequenceAge)
+	}
+	if minSequenceLedgerGap := envelope.MinSeqLedgerGap(); minSequenceLedgerGap != nil {
+		opts.MinSequenceLedgerGap = uint32(*minSequenceLedgerGap)
+	}
+	for _, signer := range envelope.ExtraSigners() {
+		key, err := signer.GetAddress()
+		if err != nil {
+			return nil, logical.CodedError(400, "invalid extra signer: "+err.Error())
+		}
+		opts.ExtraSigners = append(opts.ExtraSigners, key)
+	}
+
+	return opts, nil
+}
+
+// sep7Payload returns the payload a SEP-7 URI signature signs
+func sep7Payload(uri string) []byte {
+	payload := make([]byte, 36)
+	payload[35] = 4
+	return append(payload, []byte("stellar.sep.7 - URI Scheme"+uri)...)
+}
+
+// sep7Escape percent encodes a URI parameter value
+func sep7Escape(value string) string {
+	return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+}
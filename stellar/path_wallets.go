@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/stellar/go/exp/crypto/derivation"
+	"github.com/stellar/go/keypair"
+	"github.com/tyler-smith/go-bip39"
+	"strconv"
+	"strings"
+)
+
+// Wallet is a BIP-39 mnemonic from which accounts are derived per SEP-5
+type Wallet struct {
+	Mnemonic   string            `json:"mnemonic"`
+	Passphrase string            `json:"passphrase"` // Optional BIP-39 passphrase
+	NextIndex  uint32            `json:"next_index"` // Lowest index not derived yet
+	Accounts   map[string]string `json:"accounts"`   // Names of the derived accounts, keyed by index
+}
+
+// Register the callbacks for the paths exposed by these functions
+func walletsPaths(b *backend) []*framework.Path {
+	return []*framework.Path{
+		&framework.Path{
+			Pattern: "wallets/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.listWallets,
+			},
+		},
+		&framework.Path{
+			Pattern:      "wallets/" + framework.GenericNameRegex("name"),
+			HelpSynopsis: "Generate or import a BIP-39 mnemonic from which accounts are derived",
+			Fields: map[string]*framework.FieldSchema{
+				"name": &framework.FieldSchema{Type: framework.TypeString},
+				"mnemonic": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) Existing BIP-39 mnemonic to import, a new one is generated otherwise",
+				},
+				"passphrase": &framework.FieldSchema{
+					Type:        framework.TypeString,
+					Description: "(Optional) BIP-39 passphrase protecting the mnemonic",
+				},
+				"words": &framework.FieldSchema{
+					Type:        framework.TypeInt,
+					Description: "(Optional) Number of words of a generated mnemonic, 12 or 24",
+					Default:     24,
+				},
+			},
+			ExistenceCheck: b.walletExistenceCheck,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.CreateOperation: b.createWallet,
+				logical.ReadOperation:   b.readWallet,
+				logical.DeleteOperation: b.deleteWallet,
+			},
+		},
+	}
+}
+
+// Returns the names of all stored wallets
+func (b *backend) listWallets(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	wallets, err := req.Storage.List(ctx, "wallets/")
+	if err != nil {
+		return nil, err
+	}
+	return logical.ListResponse(wallets), nil
+}
+
+// Writes to an existing wallet are updates, which are refused so that a mnemonic is never replaced
+func (b *backend) walletExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	wallet, err := b.readStoredWallet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+	return wallet != nil, nil
+}
+
+// Generates or imports the mnemonic of a new wallet. A generated mnemonic is returned once, to be backed up.
+func (b *backend) createWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+
+	// Validate we didn't get extra fields
+	err := validateFields(req, d)
+	if err != nil {
+		return nil, logical.CodedError(400, err.Error())
+	}
+
+	mnemonic := strings.Join(strings.Fields(d.Get("mnemonic").(string)), " ")
+	generated := mnemonic == ""
+	if generated {
+		var bits int
+		switch d.Get("words").(int) {
+		case 12:
+			bits = 128
+		case 24:
+			bits = 256
+		default:
+			return nil, logical.CodedError(400, "words must be 12 or 24")
+		}
+		entropy, err := bip39.NewEntropy(bits)
+		if err != nil {
+			return nil, err
+		}
+		mnemonic, err = bip39.NewMnemonic(entropy)
+		if err != nil {
+			return nil, err
+		}
+	} else if !bip39.IsMnemonicValid(mnemonic) {
+		return nil, logical.CodedError(400, "mnemonic is not a valid BIP-39 mnemonic")
+	}
+
+	wallet := &Wallet{
+		Mnemonic:   mnemonic,
+		Passphrase: d.Get("passphrase").(string),
+		Accounts:   make(map[string]string),
+	}
+
+	// Derive the primary account up front, so that a mnemonic which can't be used is refused now
+	primary, err := deriveKeypair(wallet, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.storeWallet(ctx, req.Storage, d.Get("name").(string), wallet); err != nil {
+		return nil, err
+	}
+
+	data := walletResponseData(wallet)
+	data["primary_address"] = primary.Address()
+	if generated {
+		data["mnemonic"] = mnemonic
+	}
+	return &logical.Response{
+		Data: data,
+	}, nil
+}
+
+// Returns the derivation state of a wallet, without its mnemonic
+func (b *backend) readWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	wallet, err := b.readStoredWallet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if wallet == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: walletResponseData(wallet),
+	}, nil
+}
+
+// Deletes a wallet. Accounts derived from it keep their keys.
+func (b *backend) deleteWallet(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	if err := req.Storage.Delete(ctx, "wallets/"+d.Get("name").(string)); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// deriveWalletAccount reserves an index of the wallet for the account and derives its keypair. A negative index
+// takes the next unused one. Deriving an index again for the account it was derived for recreates the same keys.
+func (b *backend) deriveWalletAccount(ctx context.Context, s logical.Storage, walletName string, index int, accountName string) (*keypair.Full, uint32, error) {
+	b.walletLock.Lock()
+	defer b.walletLock.Unlock()
+
+	wallet, err := b.readStoredWallet(ctx, s, walletName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if wallet == nil {
+		return nil, 0, logical.CodedError(400, "wallet not found: "+walletName)
+	}
+
+	// A retry after a failed account creation reuses the index reserved for the account
+	if index < 0 {
+		index = int(wallet.NextIndex)
+		for key, existing := range wallet.Accounts {
+			if existing == accountName {
+				index, _ = strconv.Atoi(key)
+			}
+		}
+	}
+	if index >= 1<<31 {
+		return nil, 0, logical.CodedError(400, "wallet_index must be below 2^31")
+	}
+	key := strconv.Itoa(index)
+	if existing, ok := wallet.Accounts[key]; ok && existing != accountName {
+		return nil, 0, logical.CodedError(409, fmt.Sprintf("wallet index %d is already derived for account %s", index, existing))
+	}
+
+	kp, err := deriveKeypair(wallet, uint32(index))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if wallet.Accounts == nil {
+		wallet.Accounts = make(map[string]string)
+	}
+	wallet.Accounts[key] = accountName
+	if uint32(index) >= wallet.NextIndex {
+		wallet.NextIndex = uint32(index) + 1
+	}
+	if err := b.storeWallet(ctx, s, walletName, wallet); err != nil {
+		return nil, 0, err
+	}
+	return kp, uint32(index), nil
+}
+
+// deriveKeypair derives the keypair at m/44'/148'/index' of the wallet, per SEP-5
+func deriveKeypair(wallet *Wallet, index uint32) (*keypair.Full, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(wallet.Mnemonic, wallet.Passphrase)
+	if err != nil {
+		return nil, logical.CodedError(400, "mnemonic is not a valid BIP-39 mnemonic")
+	}
+	key, err := derivation.DeriveForPath(fmt.Sprintf(derivation.StellarAccountPathFormat, index), seed)
+	if err != nil {
+		return nil, err
+	}
+	return keypair.FromRawSeed(key.RawSeed())
+}
+
+func (b *backend) storeWallet(ctx context.Context, s logical.Storage, name string, wallet *Wallet) error {
+	entry, err := logical.StorageEntryJSON("wallets/"+name, wallet)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+func (b *backend) readStoredWallet(ctx context.Context, s logical.Storage, name string) (*Wallet, error) {
+	entry, err := s.Get(ctx, "wallets/"+name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wallet %s", name)
+	}
+	if entry == nil || len(entry.Value) == 0 {
+		return nil, nil
+	}
+
+	var wallet Wallet
+	if err := entry.DecodeJSON(&wallet); err != nil {
+		return nil, fmt.Errorf("failed to deserialize wallet %s", name)
+	}
+	return &wallet, nil
+}
+
+// walletResponseData returns the derivation state of a wallet. The mnemonic is never included.
+func walletResponseData(wallet *Wallet) map[string]interface{} {
+	return map[string]interface{}{
+		"words":      len(strings.Fields(wallet.Mnemonic)),
+		"next_index": wallet.NextIndex,
+		"accounts":   wallet.Accounts,
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestPropagateRole(t *testing.T) {
+	b, storage := getTestBackend(t)
+	whitelisted := randomAccount(t)
+
+	request := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	request("roles/ops", map[string]interface{}{"starting_balance": "5", "tx_spend_limit": "100"})
+
+	issued := randomAccount(t)
+	issued.Role = "ops"
+	issued.TxSpendLimit = "100"
+	putTestAccount(t, storage, "issued", issued)
+	other := randomAccount(t)
+	other.Role = "ops-long"
+	other.TxSpendLimit = "100"
+	putTestAccount(t, storage, "other", other)
+
+	resp := request("roles/ops", map[string]interface{}{
+		"starting_balance": "5",
+		"tx_spend_limit":   "50",
+		"whitelist":        whitelisted.Address,
+		"metadata":         "team=payments",
+		"propagate":        true,
+	})
+	propagated := resp.Data["propagated_accounts"].([]string)
+	if len(propagated) != 1 || propagated[0] != "issued" {
+		t.Fatalf("expected only the account created from the role to be updated, got %v", propagated)
+	}
+
+	updated, err := b.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: storage}, "accounts/issued")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.TxSpendLimit != "50" || len(updated.Whitelist) != 1 || updated.Whitelist[0] != whitelisted.Address ||
+		updated.Metadata["team"] != "payments" {
+		t.Fatalf("expected the policies of the role to be applied, got %+v", updated)
+	}
+	if updated.Seed != issued.Seed {
+		t.Fatal("expected the keys of the account to be kept")
+	}
+
+	unchanged, err := b.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: storage}, "accounts/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unchanged.TxSpendLimit != "100" {
+		t.Fatalf("expected the account of another role to be unchanged, got %s", unchanged.TxSpendLimit)
+	}
+}
+
+func TestUpdateAccount_keepsRoleOverrides(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	request := func(path string, data map[string]interface{}) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			Storage:   storage,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != nil && resp.IsError() {
+			t.Fatal(resp.Error())
+		}
+	}
+	readAccount := func() *Account {
+		account, err := b.(*backend).readVaultAccount(context.Background(), &logical.Request{Storage: storage}, "accounts/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return account
+	}
+	request("roles/ops", map[string]interface{}{"starting_balance": "5", "tx_spend_limit": "100", "metadata": "team=payments"})
+
+	account := randomAccount(t)
+	account.Role = "ops"
+	account.TxSpendLimit = "1000"
+	account.Metadata = map[string]string{"team": "treasury"}
+	putTestAccount(t, storage, "x", account)
+
+	// Updates without a role keep the values the account was given over those of its role
+	request("accounts/x", map[string]interface{}{"offer_price_band": "0.05"})
+	updated := readAccount()
+	if updated.Role != "ops" || updated.TxSpendLimit != "1000" || updated.Metadata["team"] != "treasury" {
+		t.Fatalf("expected the overrides of the account to be kept, got %+v", updated)
+	}
+
+	// Giving the role again applies it, except for the fields given in the request
+	request("accounts/x", map[string]interface{}{"role": "ops", "approval_threshold": "10"})
+	updated = readAccount()
+	if updated.TxSpendLimit != "100" || updated.Metadata["team"] != "payments" || updated.ApprovalThreshold != "10" {
+		t.Fatalf("expected the role to be applied, got %+v", updated)
+	}
+	if updated.OfferPriceBand != "0.05" {
+		t.Fatalf("expected policies the role doesn't provide to be kept, got %s", updated.OfferPriceBand)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+)
+
+func TestValidateChallenge(t *testing.T) {
+	b, _ := getTestBackend(t)
+	server := keypair.MustRandom()
+	client := keypair.MustRandom()
+	other := keypair.MustRandom()
+	nonce := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 48))
+	now := time.Now().Unix()
+
+	// challenge builds a valid challenge, changed by the test before it is signed by the signer
+	challenge := func(change func(params *txnbuild.TransactionParams), signer *keypair.Full) *txnbuild.Transaction {
+		params := txnbuild.TransactionParams{
+			SourceAccount: &txnbuild.SimpleAccount{AccountID: server.Address(), Sequence: 0},
+			Operations: []txnbuild.Operation{
+				&txnbuild.ManageData{SourceAccount: client.Address(), Name: "example.com auth", Value: []byte(nonce)},
+				&txnbuild.ManageData{SourceAccount: server.Address(), Name: "web_auth_domain", Value: []byte("auth.example.com")},
+			},
+			BaseFee:       txnbuild.MinBaseFee,
+			Preconditions: txnbuild.Preconditions{TimeBounds: txnbuild.NewTimebounds(now, now+300)},
+		}
+		if change != nil {
+			change(&params)
+		}
+		tx, err := txnbuild.NewTransaction(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer != nil {
+			if tx, err = tx.Sign(b.(*backend).networkPassphrase, signer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tx
+	}
+	setOp := func(i int, op txnbuild.Operation) func(params *txnbuild.TransactionParams) {
+		return func(params *txnbuild.TransactionParams) {
+			params.Operations[i] = op
+		}
+	}
+
+	tests := []struct {
+		name string
+		tx   *txnbuild.Transaction
+		err  string // Part of the expected error, empty when the challenge is valid
+	}{
+		{"valid", challenge(nil, server), ""},
+		{"client domain", challenge(func(params *txnbuild.TransactionParams) {
+			params.Operations = append(params.Operations, &txnbuild.ManageData{SourceAccount: other.Address(), Name: "client_domain", Value: []byte("wallet.example.com")})
+		}, server), ""},
+		{"id memo", challenge(func(params *txnbuild.TransactionParams) {
+			params.Memo = txnbuild.MemoID(42)
+		}, server), ""},
+		{"sequence", challenge(func(params *txnbuild.TransactionParams) {
+			params.SourceAccount = &txnbuild.SimpleAccount{AccountID: server.Address(), Sequence: 1}
+		}, server), "sequence number"},
+		{"source account", challenge(func(params *txnbuild.TransactionParams) {
+			params.SourceAccount = &txnbuild.SimpleAccount{AccountID: other.Address()}
+		}, other), "not the server account"},
+		{"text memo", challenge(func(params *txnbuild.TransactionParams) {
+			params.Memo = txnbuild.MemoText("hello")
+		}, server), "memo"},
+		{"payment", challenge(setOp(1, &txnbuild.Payment{SourceAccount: server.Address(), Destination: client.Address(), Amount: "1", Asset: txnbuild.NativeAsset{}}), server), "not a manage data operation"},
+		{"bump sequence", challenge(func(params *txnbuild.TransactionParams) {
+			params.Operations = []txnbuild.Operation{&txnbuild.BumpSequence{BumpTo: 1}}
+		}, server), "not a manage data operation"},
+		{"other client", challenge(setOp(0, &txnbuild.ManageData{SourceAccount: other.Address(), Name: "example.com auth", Value: []byte(nonce)}), server), "not for account"},
+		{"home domain", challenge(setOp(0, &txnbuild.ManageData{SourceAccount: client.Address(), Name: "other.com auth", Value: []byte(nonce)}), server), "home domain"},
+		{"short nonce", challenge(setOp(0, &txnbuild.ManageData{SourceAccount: client.Address(), Name: "example.com auth", Value: []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))}), server), "nonce"},
+		{"nonce not base64", challenge(setOp(0, &txnbuild.ManageData{SourceAccount: client.Address(), Name: "example.com auth", Value: []byte(strings.Repeat("!", 64))}), server), "nonce"},
+		{"client operation", challenge(setOp(1, &txnbuild.ManageData{SourceAccount: client.Address(), Name: "web_auth_domain", Value: []byte("auth.example.com")}), server), "client account"},
+		{"other operation source", challenge(setOp(1, &txnbuild.ManageData{SourceAccount: other.Address(), Name: "web_auth_domain", Value: []byte("auth.example.com")}), server), "not sourced by the server"},
+		{"web auth domain", challenge(setOp(1, &txnbuild.ManageData{SourceAccount: server.Address(), Name: "web_auth_domain", Value: []byte("evil.example.com")}), server), "web_auth_domain"},
+		{"expired", challenge(func(params *txnbuild.TransactionParams) {
+			params.Preconditions.TimeBounds = txnbuild.NewTimebounds(now-600, now-300)
+		}, server), "time bounds"},
+		{"not yet valid", challenge(func(params *txnbuild.TransactionParams) {
+			params.Preconditions.TimeBounds = txnbuild.NewTimebounds(now+3600, now+3900)
+		}, server), "time bounds"},
+		{"infinite", challenge(func(params *txnbuild.TransactionParams) {
+			params.Preconditions.TimeBounds = txnbuild.NewTimebounds(now, 0)
+		}, server), "time bounds must be set"},
+		{"unsigned", challenge(nil, nil), "not signed"},
+		{"signed by client", challenge(nil, client), "not signed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := b.(*backend).validateChallenge(test.tx, client.Address(), server.Address(), "example.com", "auth.example.com")
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
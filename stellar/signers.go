@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/txnbuild"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// How long the signers and thresholds of an account loaded from Horizon are reused
+const signerCacheTTL = 30 * time.Second
+
+// Above this many candidate keys we select signers greedily rather than searching for the smallest set
+const maxExhaustiveSigners = 16
+
+// thresholdLevel is one of the three signature thresholds of a Stellar account
+type thresholdLevel int
+
+const (
+	thresholdLow thresholdLevel = iota
+	thresholdMedium
+	thresholdHigh
+)
+
+func (l thresholdLevel) String() string {
+	switch l {
+	case thresholdLow:
+		return "low"
+	case thresholdMedium:
+		return "medium"
+	default:
+		return "high"
+	}
+}
+
+// accountSigners is the cached copy of the signers and thresholds of a Stellar account
+type accountSigners struct {
+	weights    map[string]int32
+	thresholds hProtocol.AccountThresholds
+	loadedAt   time.Time
+}
+
+// SignerRequirement is the threshold a source account of the transaction needed, and the weight that was signed
+type SignerRequirement struct {
+	Account   string `json:"account"`
+	Threshold string `json:"threshold"`
+	Required  int32  `json:"required"`
+	Weight    int32  `json:"weight"`
+}
+
+// SignerUsage is a key which signed the transaction and the weight it contributed to each source account
+type SignerUsage struct {
+	Address string           `json:"address"`
+	Weights map[string]int32 `json:"weights"`
+}
+
+// SignatureExplanation explains which keys signed a transaction and why
+type SignatureExplanation struct {
+	Signers      []SignerUsage       `json:"signers"`
+	Requirements []SignerRequirement `json:"requirements"`
+}
+
+// requiredWeight returns the signature weight needed to meet the threshold. A threshold of 0 still requires a signature.
+func requiredWeight(thresholds hProtocol.AccountThresholds, level thresholdLevel) int32 {
+	var required int32
+	switch level {
+	case thresholdLow:
+		required = int32(thresholds.LowThreshold)
+	case thresholdMedium:
+		required = int32(thresholds.MedThreshold)
+	default:
+		required = int32(thresholds.HighThreshold)
+	}
+	if required == 0 {
+		required = 1
+	}
+	return required
+}
+
+// operationThreshold returns the threshold of the operation source account which the operation requires
+func operationThreshold(op txnbuild.Operation) thresholdLevel {
+	switch o := op.(type) {
+	case *txnbuild.AllowTrust, *txnbuild.SetTrustLineFlags, *txnbuild.BumpSequence, *txnbuild.ClaimClaimableBalance, *txnbuild.Inflation:
+		return thresholdLow
+	case *txnbuild.AccountMerge:
+		return thresholdHigh
+	case *txnbuild.SetOptions:
+		if o.MasterWeight != nil || o.LowThreshold != nil || o.MediumThreshold != nil || o.HighThreshold != nil || o.Signer != nil {
+			return thresholdHigh
+		}
+	}
+	return thresholdMedium
+}
+
+// requiredThresholds returns the highest threshold needed from each source account of the transaction, muxed
+// sources counting as their account. The transaction source account always needs the low threshold to pay the fee
+// and consume the sequence number.
+func requiredThresholds(tx *txnbuild.Transaction) map[string]thresholdLevel {
+	txSource := baseAddress(tx.SourceAccount().AccountID)
+	levels := map[string]thresholdLevel{txSource: thresholdLow}
+	for _, op := range tx.Operations() {
+		source := baseAddress(op.GetSourceAccount())
+		if source == "" {
+			source = txSource
+		}
+		if level, ok := levels[source]; !ok || operationThreshold(op) > level {
+			levels[source] = operationThreshold(op)
+		}
+	}
+	return levels
+}
+
+// loadSigners returns the signers and thresholds of the account, from the cache if it is recent enough
+func (b *backend) loadSigners(address string) (*accountSigners, error) {
+	b.signerCacheLock.RLock()
+	cached, ok := b.signerCache[address]
+	b.signerCacheLock.RUnlock()
+	if ok && time.Since(cached.loadedAt) < signerCacheTTL {
+		return cached, nil
+	}
+
+	account, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: address})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load signers of "+address)
+	}
+
+	signers := &accountSigners{
+		weights:    make(map[string]int32),
+		thresholds: account.Thresholds,
+		loadedAt:   time.Now(),
+	}
+	for _, signer := range account.Signers {
+		signers.weights[signer.Key] = signer.Weight
+	}
+
+	b.signerCacheLock.Lock()
+	b.signerCache[address] = signers
+	b.signerCacheLock.Unlock()
+
+	return signers, nil
+}
+
+// invalidateSigners drops the cached signers of the account, after they have been changed
+func (b *backend) invalidateSigners(address string) {
+	b.signerCacheLock.Lock()
+	delete(b.signerCache, address)
+	b.signerCacheLock.Unlock()
+}
+
+// selectSigners returns the smallest set of the candidate Vault accounts whose signatures meet the thresholds each
+// source account of the transaction requires. Stellar rejects transactions with more signatures than needed
+// (https://github.com/stellar/stellar-protocol/issues/120), so only this set may sign.
+func (b *backend) selectSigners(tx *txnbuild.Transaction, candidates ...*Account) ([]*Account, *SignatureExplanation, error) {
+	return b.selectSignersForThresholds(requiredThresholds(tx), candidates...)
+}
+
+// selectSignersForThresholds returns the smallest set of the candidate Vault accounts whose signatures meet the
+// threshold required from each of the given accounts.
+func (b *backend) selectSignersForThresholds(levels map[string]thresholdLevel, candidates ...*Account) ([]*Account, *SignatureExplanation, error) {
+	// Sort the source accounts so that explanations are stable
+	var sources []string
+	for source := range levels {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	required := make([]int32, len(sources))
+	weights := make([]map[string]int32, len(sources))
+	for i, source := range sources {
+		signers, err := b.loadSigners(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		required[i] = requiredWeight(signers.thresholds, levels[source])
+		weights[i] = signers.weights
+	}
+
+	// Only keep the candidates which are signers of at least one source account
+	var useful []*Account
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if seen[candidate.Address] {
+			continue
+		}
+		seen[candidate.Address] = true
+		for i := range sources {
+			if weights[i][candidate.Address] > 0 {
+				useful = append(useful, candidate)
+				break
+			}
+		}
+	}
+
+	satisfied := func(set []*Account) bool {
+		for i := range sources {
+			var total int32
+			for _, signer := range set {
+				total += weights[i][signer.Address]
+			}
+			if total < required[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var selected []*Account
+	if len(useful) <= maxExhaustiveSigners {
+		// Try every subset in order of increasing size, so the first match is a smallest one
+	search:
+		for size := 1; size <= len(useful); size++ {
+			for mask := 1; mask < 1<<uint(len(useful)); mask++ {
+				if bits.OnesCount(uint(mask)) != size {
+					continue
+				}
+				var set []*Account
+				for i, candidate := range useful {
+					if mask&(1<<uint(i)) != 0 {
+						set = append(set, candidate)
+					}
+				}
+				if satisfied(set) {
+					selected = set
+					break search
+				}
+			}
+		}
+	} else {
+		// Add signers until the thresholds are met, then drop any which turned out not to be needed
+		for _, candidate := range useful {
+			selected = append(selected, candidate)
+			if satisfied(selected) {
+				break
+			}
+		}
+		for i := len(selected) - 1; i >= 0; i-- {
+			without := append(append([]*Account{}, selected[:i]...), selected[i+1:]...)
+			if satisfied(without) {
+				selected = without
+			}
+		}
+	}
+
+	if selected == nil || !satisfied(selected) {
+		for i, source := range sources {
+			var total int32
+			for _, candidate := range useful {
+				total += weights[i][candidate.Address]
+			}
+			if total < required[i] {
+				return nil, nil, fmt.Errorf("the available signers do not meet the %s threshold (%d) of %s", levels[source], required[i], source)
+			}
+		}
+		return nil, nil, fmt.Errorf("the available signers do not meet the thresholds of the transaction")
+	}
+
+	explanation := &SignatureExplanation{}
+	for _, signer := range selected {
+		usage := SignerUsage{Address: signer.Address, Weights: make(map[string]int32)}
+		for i, source := range sources {
+			if weight := weights[i][signer.Address]; weight > 0 {
+				usage.Weights[source] = weight
+			}
+		}
+		explanation.Signers = append(explanation.Signers, usage)
+	}
+	for i, source := range sources {
+		var total int32
+		for _, signer := range selected {
+			total += weights[i][signer.Address]
+		}
+		explanation.Requirements = append(explanation.Requirements, SignerRequirement{
+			Account:   source,
+			Threshold: levels[source].String(),
+			Required:  required[i],
+			Weight:    total,
+		})
+	}
+
+	return selected, explanation, nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"testing"
+	"time"
+
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/txnbuild"
+)
+
+func TestSelectSigners_minimalSet(t *testing.T) {
+	b := Backend()
+
+	source := randomAccount(t)
+	signer1 := randomAccount(t)
+	signer2 := randomAccount(t)
+	signer3 := randomAccount(t)
+
+	// The medium threshold of 3 can be met by signer1 and signer3, or by signer3 alone
+	b.signerCache[source.Address] = &accountSigners{
+		weights: map[string]int32{
+			source.Address:  1,
+			signer1.Address: 1,
+			signer2.Address: 1,
+			signer3.Address: 3,
+		},
+		thresholds: hProtocol.AccountThresholds{LowThreshold: 1, MedThreshold: 3, HighThreshold: 5},
+		loadedAt:   time.Now(),
+	}
+
+	tx, err := txnbuild.NewTransaction(txnbuild.TransactionParams{
+		SourceAccount:        &txnbuild.SimpleAccount{AccountID: source.Address, Sequence: 1},
+		IncrementSequenceNum: true,
+		Operations:           []txnbuild.Operation{&txnbuild.Payment{Destination: signer1.Address, Amount: "1", Asset: txnbuild.NativeAsset{}}},
+		BaseFee:              txnbuild.MinBaseFee,
+		Preconditions:        txnbuild.Preconditions{TimeBounds: txnbuild.NewInfiniteTimeout()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signers, explanation, err := b.selectSigners(tx, source, signer1, signer2, signer3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || signers[0].Address != signer3.Address {
+		t.Fatalf("expected only signer3 to sign, got %v", explanation.Signers)
+	}
+	if explanation.Requirements[0].Threshold != "medium" || explanation.Requirements[0].Weight != 3 {
+		t.Fatalf("unexpected requirements: %v", explanation.Requirements)
+	}
+
+	// Without signer3, three signatures of weight 1 are needed
+	signers, _, err = b.selectSigners(tx, source, signer1, signer2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 3 {
+		t.Fatalf("expected 3 signers, got %d", len(signers))
+	}
+
+	// The high threshold can't be met without signer3
+	merge := &txnbuild.AccountMerge{Destination: signer1.Address}
+	tx, err = txnbuild.NewTransaction(txnbuild.TransactionParams{
+		SourceAccount:        &txnbuild.SimpleAccount{AccountID: source.Address, Sequence: 1},
+		IncrementSequenceNum: true,
+		Operations:           []txnbuild.Operation{merge},
+		BaseFee:              txnbuild.MinBaseFee,
+		Preconditions:        txnbuild.Preconditions{TimeBounds: txnbuild.NewInfiniteTimeout()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.selectSigners(tx, source, signer1, signer2); err == nil {
+		t.Fatal("expected the high threshold not to be met")
+	}
+}
+
+func TestCheckControllable(t *testing.T) {
+	master := randomAccount(t).Address
+	cosigner := randomAccount(t).Address
+	hashX, err := strkey.Encode(strkey.VersionByteHashX, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		weights    map[string]int32
+		changedKey string
+		high       int32
+		valid      bool
+	}{
+		{"master meets threshold", map[string]int32{master: 2}, "", 2, true},
+		{"master below threshold", map[string]int32{master: 1}, "", 2, false},
+		{"signers together meet threshold", map[string]int32{master: 1, cosigner: 1}, cosigner, 2, true},
+		{"removing the last signer", map[string]int32{master: 0}, "", 0, false},
+		{"removing a needed signer", map[string]int32{master: 1, cosigner: 0}, cosigner, 2, false},
+		{"hash signers don't count", map[string]int32{master: 1, hashX: 5}, hashX, 2, false},
+	}
+	for _, c := range cases {
+		err := checkControllable(c.weights, c.changedKey, c.high)
+		if c.valid && err != nil {
+			t.Errorf("%s: expected the change to be allowed, got %v", c.name, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("%s: expected the change to be refused", c.name)
+		}
+	}
+}
+
+func TestSignerWeights_onlyEd25519(t *testing.T) {
+	master := randomAccount(t).Address
+	hashX, err := strkey.Encode(strkey.VersionByteHashX, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	weights := signerWeights(hProtocol.Account{Signers: []hProtocol.Signer{
+		{Key: master, Weight: 1},
+		{Key: hashX, Weight: 5},
+	}})
+	if len(weights) != 1 || weights[master] != 1 {
+		t.Fatalf("expected only the ed25519 signer, got %v", weights)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/shopspring/decimal"
+	"github.com/stellar/go/keypair"
+)
+
+func TestCheckSponsorshipLimit(t *testing.T) {
+	b := Backend()
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+	sponsor := &Account{SponsorshipLimit: 2}
+	sponsored := randomAccount(t).Address
+
+	for _, asset := range []string{"USD:" + sponsored, "EUR:" + sponsored} {
+		if err := b.checkSponsorshipLimit(context.Background(), req, "sponsor", sponsor); err != nil {
+			t.Fatalf("expected the trustline to %s to be within the limit, got %v", asset, err)
+		}
+		if _, err := b.recordSponsorship(context.Background(), req, "sponsor", sponsorshipTrustline, sponsored, asset, "hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.checkSponsorshipLimit(context.Background(), req, "sponsor", sponsor); errorCode(err) != 403 {
+		t.Fatalf("expected the limit to be reached, got %v", err)
+	}
+
+	// Entries sponsored by other accounts don't count, and an account without a limit may sponsor any number
+	if err := b.checkSponsorshipLimit(context.Background(), req, "other", sponsor); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkSponsorshipLimit(context.Background(), req, "sponsor", &Account{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A removed trustline frees its place
+	if err := b.forgetSponsorships(context.Background(), req, sponsorshipTrustline, sponsored, "USD:"+sponsored); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.checkSponsorshipLimit(context.Background(), req, "sponsor", sponsor); err != nil {
+		t.Fatalf("expected a forgotten sponsorship not to count, got %v", err)
+	}
+}
+
+func TestCreateSponsoredAccount_startingBalancePolicies(t *testing.T) {
+	b := Backend()
+	req := &logical.Request{Storage: &logical.InmemStorage{}}
+	sponsor := randomAccount(t)
+	sponsor.TxSpendLimit = "10"
+	sponsor.ApprovalThreshold = "5"
+
+	cases := []struct {
+		name    string
+		balance int64
+	}{
+		{"above the spend limit", 11},
+		{"above the approval threshold", 6},
+	}
+	for _, c := range cases {
+		newAccount, err := keypair.Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.createSponsoredAccount(context.Background(), req, "sponsor", sponsor, newAccount, decimal.New(c.balance, 0))
+		if errorCode(err) != 403 {
+			t.Errorf("%s: expected the starting balance to be refused, got %v", c.name, err)
+		}
+	}
+}
+
+func TestValidFunding(t *testing.T) {
+	b := Backend()
+	address := randomAccount(t).Address
+	other := randomAccount(t).Address
+
+	cases := []struct {
+		name    string
+		funding *Account
+		valid   bool
+	}{
+		{"no policies", &Account{}, true},
+		{"within the spend limit", &Account{TxSpendLimit: "5"}, true},
+		{"above the spend limit", &Account{TxSpendLimit: "1"}, false},
+		{"blacklisted", &Account{Blacklist: []string{address}}, false},
+		{"whitelisted", &Account{Whitelist: []string{address}}, true},
+		{"not whitelisted", &Account{Whitelist: []string{other}}, false},
+		{"native not allowed", &Account{AllowedAssets: []string{"USD:" + other}}, false},
+	}
+	for _, c := range cases {
+		err := b.validFunding(c.funding, address, decimal.NewFromFloat(2.5))
+		if c.valid && err != nil {
+			t.Errorf("%s: expected the funding to be allowed, got %v", c.name, err)
+		}
+		if !c.valid && errorCode(err) != 403 {
+			t.Errorf("%s: expected the funding to be refused, got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/protocols/horizon/operations"
+)
+
+func TestApplySubaccountDebit(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  string
+		refund  bool
+		balance string
+		wantErr bool
+	}{
+		{name: "debit within balance", amount: "40", balance: "60"},
+		{name: "debit of the whole balance", amount: "100", balance: "0"},
+		{name: "overdraft refused", amount: "100.5", balance: "100", wantErr: true},
+		{name: "refund restores balance", amount: "40", refund: true, balance: "140"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Backend()
+			storage := &logical.InmemStorage{}
+			ctx := context.Background()
+			now := time.Now().UTC()
+			if err := b.storeSubaccount(ctx, storage, "x", &Subaccount{
+				ID:        "7",
+				Balances:  map[string]string{"native": "100"},
+				CreatedAt: now,
+				UpdatedAt: now,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			debit := &SubaccountDebit{Account: "x", Subaccount: "7", Asset: "native", Amount: tt.amount}
+			err := b.applySubaccountDebit(ctx, storage, debit, tt.refund)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			subaccount, err := b.readStoredSubaccount(ctx, storage, "x", "7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subaccount.Balances["native"] != tt.balance {
+				t.Fatalf("expected balance %s, got %s", tt.balance, subaccount.Balances["native"])
+			}
+		})
+	}
+}
+
+func TestSubaccountIDOf(t *testing.T) {
+	withMemo := func(memoType, memo string) operations.Payment {
+		var payment operations.Payment
+		payment.Transaction = &hProtocol.Transaction{MemoType: memoType, Memo: memo}
+		return payment
+	}
+	muxed := withMemo("text", "99")
+	muxed.ToMuxed = "MA..."
+	muxed.ToMuxedID = 7
+
+	tests := []struct {
+		name    string
+		payment operations.Payment
+		want    string
+	}{
+		{name: "muxed id", payment: muxed, want: "7"},
+		{name: "id memo", payment: withMemo("id", "42"), want: "42"},
+		{name: "numeric text memo", payment: withMemo("text", "007"), want: "7"},
+		{name: "non-numeric text memo", payment: withMemo("text", "order 42"), want: ""},
+		{name: "hash memo", payment: withMemo("hash", "AAAA"), want: ""},
+		{name: "no memo", payment: withMemo("none", ""), want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subaccountIDOf(tt.payment); got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stellar/go/clients/horizonclient"
+	hProtocol "github.com/stellar/go/protocols/horizon"
+	"github.com/stellar/go/support/render/problem"
+	"github.com/stellar/go/txnbuild"
+	"github.com/stellar/go/xdr"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestOperationResultCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		result xdr.OperationResult
+		code   string
+	}{
+		{
+			"operation failed",
+			xdr.OperationResult{Code: xdr.OperationResultCodeOpBadAuth},
+			xdr.OperationResultCodeOpBadAuth.String(),
+		},
+		{
+			"payment failed",
+			xdr.OperationResult{Code: xdr.OperationResultCodeOpInner, Tr: &xdr.OperationResultTr{
+				Type:          xdr.OperationTypePayment,
+				PaymentResult: &xdr.PaymentResult{Code: xdr.PaymentResultCodePaymentUnderfunded},
+			}},
+			xdr.PaymentResultCodePaymentUnderfunded.String(),
+		},
+		{
+			"create account failed",
+			xdr.OperationResult{Code: xdr.OperationResultCodeOpInner, Tr: &xdr.OperationResultTr{
+				Type:                xdr.OperationTypeCreateAccount,
+				CreateAccountResult: &xdr.CreateAccountResult{Code: xdr.CreateAccountResultCodeCreateAccountLowReserve},
+			}},
+			xdr.CreateAccountResultCodeCreateAccountLowReserve.String(),
+		},
+		{
+			"unknown operation type",
+			xdr.OperationResult{Code: xdr.OperationResultCodeOpInner, Tr: &xdr.OperationResultTr{
+				Type:             xdr.OperationTypeSetOptions,
+				SetOptionsResult: &xdr.SetOptionsResult{Code: xdr.SetOptionsResultCodeSetOptionsLowReserve},
+			}},
+			xdr.OperationTypeSetOptions.String(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := operationResultCode(test.result); code != test.code {
+				t.Fatalf("expected %s, got %s", test.code, code)
+			}
+		})
+	}
+}
+
+func TestReconcileTransactions_cap(t *testing.T) {
+	b, storage := getTestBackend(t)
+	ctx := context.Background()
+
+	// None of the transactions made it into a ledger before their time bounds
+	client := &horizonclient.MockClient{}
+	client.On("TransactionDetail", mock.Anything).
+		Return(hProtocol.Transaction{}, &horizonclient.Error{Problem: problem.P{Status: 404}})
+	b.(*backend).horizon = client
+
+	expired := time.Now().Add(-time.Hour).Unix()
+	for i := 0; i < maxReconciledTransactions+20; i++ {
+		status := &TransactionStatus{TransactionHash: fmt.Sprintf("%064d", i), Status: txStatusPending, MaxTime: expired}
+		if i < 10 {
+			status.Status = txStatusSuccess
+		}
+		if err := b.(*backend).storeTransactionStatus(ctx, storage, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := b.(*backend).reconcileTransactions(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	client.AssertNumberOfCalls(t, "TransactionDetail", maxReconciledTransactions)
+
+	counts := make(map[string]int)
+	hashes, err := storage.List(ctx, "transaction_status/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range hashes {
+		status, err := b.(*backend).readStoredTransactionStatus(ctx, storage, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[status.Status]++
+	}
+	if counts[txStatusExpired] != maxReconciledTransactions || counts[txStatusPending] != 10 || counts[txStatusSuccess] != 10 {
+		t.Fatalf("expected one pass to check %d pending transactions, got %v", maxReconciledTransactions, counts)
+	}
+
+	// The next pass picks up the remaining ones
+	if err := b.(*backend).reconcileTransactions(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+	client.AssertNumberOfCalls(t, "TransactionDetail", maxReconciledTransactions+10)
+}
+
+func TestAuditTransaction_untrackedChallenge(t *testing.T) {
+	b, storage := getTestBackend(t)
+	ctx := context.Background()
+	source := randomAccount(t)
+
+	for sequence, tracked := range map[int64]bool{0: false, 41: true} {
+		tx, err := txnbuild.NewTransaction(txnbuild.TransactionParams{
+			SourceAccount: &txnbuild.SimpleAccount{AccountID: source.Address, Sequence: sequence},
+			Operations: []txnbuild.Operation{&txnbuild.ManageData{
+				Name:  "example.com auth",
+				Value: []byte("nonce"),
+			}},
+			BaseFee:       txnbuild.MinBaseFee,
+			Preconditions: txnbuild.Preconditions{TimeBounds: txnbuild.NewTimeout(300)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.(*backend).auditTransaction(ctx, &logical.Request{Storage: storage}, tx, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := tx.HashHex(b.(*backend).networkPassphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := b.(*backend).readStoredTransactionStatus(ctx, storage, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (status != nil) != tracked {
+			t.Fatalf("expected tracking of the transaction with sequence %d to be %v", sequence, tracked)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"github.com/pkg/errors"
+	"github.com/stellar/go/clients/horizonclient"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/txnbuild"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buildAsset returns the Stellar asset for the given code and issuer (use 'native' as the code for XLM)
+func buildAsset(assetCode string, assetIssuer string) (txnbuild.Asset, error) {
+	if strings.EqualFold(assetCode, "native") {
+		return txnbuild.NativeAsset{}, nil
+	}
+
+	// Validate that issuer is a proper stellar address
+	if _, err := keypair.Parse(assetIssuer); err != nil {
+		return nil, fmt.Errorf("invalid address for assetIssuer")
+	}
+	return txnbuild.CreditAsset{Code: assetCode, Issuer: assetIssuer}, nil
+}
+
+// transactionOptions are the options, common to every signing path, of a transaction being built. Time bounds are
+// computed when the transaction is built, so that a rebuilt transaction gets fresh ones.
+type transactionOptions struct {
+	Memo                 string   `json:"memo"`
+	MemoType             string   `json:"memo_type"` // text (the default), id or hash
+	BaseFee              int64    `json:"base_fee"`
+	Timeout              int64    `json:"timeout"`  // Seconds after being built that the transaction expires, unless MaxTime is set
+	MinTime              int64    `json:"min_time"` // Unix epoch seconds
+	MaxTime              int64    `json:"max_time"` // Unix epoch seconds
+	MinLedger            uint32   `json:"min_ledger"`
+	MaxLedger            uint32   `json:"max_ledger"`
+	MinSequenceNumber    *int64   `json:"min_sequence_number"`
+	MinSequenceAge       uint64   `json:"min_sequence_age"` // Seconds
+	MinSequenceLedgerGap uint32   `json:"min_sequence_ledger_gap"`
+	ExtraSigners         []string `json:"extra_signers"`
+}
+
+// transactionFields adds the request fields common to every signing path to the path fields
+func transactionFields(fields map[string]*framework.FieldSchema) map[string]*framework.FieldSchema {
+	fields["max_fee"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Base fee per operation to bid in stroops, overriding the configured fee",
+	}
+	fields["timeout"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "(Optional) How long the transaction is valid for, overriding the configured tx_timeout",
+	}
+	fields["min_time"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Unix time before which the transaction is not valid",
+	}
+	fields["max_time"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Unix time after which the transaction is not valid, instead of the timeout",
+	}
+	fields["min_ledger"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Ledger before which the transaction is not valid",
+	}
+	fields["max_ledger"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Ledger from which the transaction is no longer valid",
+	}
+	fields["min_sequence_number"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "(Optional) Minimum sequence number of the source account for the transaction to be valid",
+	}
+	fields["min_sequence_age"] = &framework.FieldSchema{
+		Type:        framework.TypeDurationSecond,
+		Description: "(Optional) Minimum time since the source account sequence number last changed",
+	}
+	fields["min_sequence_ledger_gap"] = &framework.FieldSchema{
+		Type:        framework.TypeInt,
+		Description: "(Optional) Minimum number of ledgers since the source account sequence number last changed",
+	}
+	fields["extra_signers"] = &framework.FieldSchema{
+		Type:        framework.TypeCommaStringSlice,
+		Description: "(Optional) Up to two signer keys (G..., T..., X... or P...) which must also sign the transaction",
+	}
+	fields["idempotency_key"] = idempotencyKeyField()
+	return fields
+}
+
+// readTransactionOptions reads the request fields common to every signing path, and chooses the transaction fee
+func (b *backend) readTransactionOptions(ctx context.Context, req *logical.Request, d *framework.FieldData) (*transactionOptions, error) {
+	config, err := b.readConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var requestedFee int64
+	if maxFee, ok := d.GetOk("max_fee"); ok {
+		requestedFee = int64(maxFee.(int))
+	}
+	baseFee, err := b.chooseBaseFee(config, requestedFee)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &transactionOptions{
+		BaseFee: baseFee,
+		Timeout: config.TxTimeout,
+	}
+
+	if timeout, ok := d.GetOk("timeout"); ok {
+		opts.Timeout = int64(timeout.(int))
+		if opts.Timeout <= 0 {
+			return nil, logical.CodedError(400, "timeout must be positive")
+		}
+	}
+	if minTime, ok := d.GetOk("min_time"); ok {
+		opts.MinTime = int64(minTime.(int))
+	}
+	if maxTime, ok := d.GetOk("max_time"); ok {
+		opts.MaxTime = int64(maxTime.(int))
+		if opts.MaxTime <= opts.MinTime || opts.MaxTime <= time.Now().Unix() {
+			return nil, logical.CodedError(400, "max_time must be in the future and after min_time")
+		}
+	}
+	if opts.MinTime < 0 || opts.MaxTime < 0 {
+		return nil, logical.CodedError(400, "min_time and max_time must not be negative")
+	}
+	// Without max_time the transaction is valid until the timeout, which must also be after min_time
+	if opts.MaxTime == 0 && opts.MinTime >= time.Now().Unix()+opts.Timeout {
+		return nil, logical.CodedError(400, "min_time must be before the transaction times out")
+	}
+
+	for field, value := range map[string]*uint32{"min_ledger": &opts.MinLedger, "max_ledger": &opts.MaxLedger, "min_sequence_ledger_gap": &opts.MinSequenceLedgerGap} {
+		if raw, ok := d.GetOk(field); ok {
+			if raw.(int) < 0 {
+				return nil, logical.CodedError(400, field+" must not be negative")
+			}
+			*value = uint32(raw.(int))
+		}
+	}
+	if opts.MaxLedger > 0 && opts.MaxLedger <= opts.MinLedger {
+		return nil, logical.CodedError(400, "max_ledger must be after min_ledger")
+	}
+
+	if minSequenceNumber := d.Get("min_sequence_number").(string); minSequenceNumber != "" {
+		value, err := strconv.ParseInt(minSequenceNumber, 10, 64)
+		if err != nil || value < 0 {
+			return nil, logical.CodedError(400, "min_sequence_number must be a non-negative integer")
+		}
+		opts.MinSequenceNumber = &value
+	}
+	if minSequenceAge, ok := d.GetOk("min_sequence_age"); ok {
+		opts.MinSequenceAge = uint64(minSequenceAge.(int))
+	}
+
+	if extraSigners, ok := d.GetOk("extra_signers"); ok {
+		opts.ExtraSigners = extraSigners.([]string)
+		if len(opts.ExtraSigners) > 2 {
+			return nil, logical.CodedError(400, "at most two extra_signers are allowed")
+		}
+		for _, signer := range opts.ExtraSigners {
+			if !validSignerKey(signer) {
+				return nil, logical.CodedError(400, "invalid extra signer: "+signer)
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+// defaultTransactionOptions returns the options of a transaction built without request fields, such as those built
+// while creating an account
+func (b *backend) defaultTransactionOptions(ctx context.Context, s logical.Storage) (*transactionOptions, error) {
+	config, err := b.readConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	baseFee, err := b.chooseBaseFee(config, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &transactionOptions{BaseFee: baseFee, Timeout: config.TxTimeout}, nil
+}
+
+// validSignerKey returns whether the key is an ed25519, pre-auth tx, hash(x) or signed payload signer key
+func validSignerKey(key string) bool {
+	for _, versionByte := range []strkey.VersionByte{strkey.VersionByteAccountID, strkey.VersionByteHashTx, strkey.VersionByteHashX, strkey.VersionByteSignedPayload} {
+		if _, err := strkey.Decode(versionByte, key); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditions returns the preconditions of a transaction built now
+func (opts *transactionOptions) preconditions() txnbuild.Preconditions {
+	maxTime := opts.MaxTime
+	if maxTime == 0 {
+		maxTime = time.Now().UTC().Unix() + opts.Timeout
+	}
+
+	preconditions := txnbuild.Preconditions{
+		TimeBounds:                 txnbuild.NewTimebounds(opts.MinTime, maxTime),
+		MinSequenceNumber:          opts.MinSequenceNumber,
+		MinSequenceNumberAge:       opts.MinSequenceAge,
+		MinSequenceNumberLedgerGap: opts.MinSequenceLedgerGap,
+		ExtraSigners:               opts.ExtraSigners,
+	}
+	if opts.MinLedger > 0 || opts.MaxLedger > 0 {
+		preconditions.LedgerBounds = &txnbuild.LedgerBounds{MinLedger: opts.MinLedger, MaxLedger: opts.MaxLedger}
+	}
+	return preconditions
+}
+
+// memo returns the memo of the transaction, if any
+func (opts *transactionOptions) memo() (txnbuild.Memo, error) {
+	if opts.Memo == "" {
+		return nil, nil
+	}
+	switch opts.MemoType {
+	case "", "text":
+		return txnbuild.MemoText(opts.Memo), nil
+	case "id":
+		id, err := strconv.ParseUint(opts.Memo, 10, 64)
+		if err != nil {
+			return nil, logical.CodedError(400, "memo is not a valid id")
+		}
+		return txnbuild.MemoID(id), nil
+	case "hash":
+		// Federation servers return hash memos base64 encoded
+		decoded, err := base64.StdEncoding.DecodeString(opts.Memo)
+		if err != nil || len(decoded) != 32 {
+			return nil, logical.CodedError(400, "memo is not a valid hash")
+		}
+		var hash txnbuild.MemoHash
+		copy(hash[:], decoded)
+		return hash, nil
+	default:
+		return nil, logical.CodedError(400, "unknown memo type: "+opts.MemoType)
+	}
+}
+
+// buildTransaction builds a transaction for the given operations, using the current sequence number of the
+// transaction source account as loaded from Horizon.
+func (b *backend) buildTransaction(sourceAddress string, opts *transactionOptions, operations ...txnbuild.Operation) (*txnbuild.Transaction, error) {
+	sourceAccount, err := b.horizon.AccountDetail(horizonclient.AccountRequest{AccountID: sourceAddress})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load transaction source account")
+	}
+
+	txMemo, err := opts.memo()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := txnbuild.NewTransaction(
+		txnbuild.TransactionParams{
+			SourceAccount:        &sourceAccount,
+			IncrementSequenceNum: true,
+			Operations:           operations,
+			BaseFee:              opts.BaseFee,
+			Memo:                 txMemo,
+			Preconditions:        opts.preconditions(),
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build transaction")
+	}
+	return tx, nil
+}
+
+// rebuildTransaction rebuilds the transaction with the current sequence number of its source account and fresh
+// time bounds, using the options it was originally built with
+func (b *backend) rebuildTransaction(tx *txnbuild.Transaction, opts *transactionOptions) (*txnbuild.Transaction, error) {
+	return b.buildTransaction(tx.SourceAccount().AccountID, opts, tx.Operations()...)
+}
+
+// signTransaction signs the transaction with the smallest set of the candidate Vault accounts which meets the
+// thresholds of its source accounts, records it in the audit ledger with the policy decisions which allowed it, and
+// explains which keys signed
+func (b *backend) signTransaction(ctx context.Context, req *logical.Request, tx *txnbuild.Transaction, decisions []string, candidates ...*Account) (*txnbuild.Transaction, *SignatureExplanation, error) {
+	signers, explanation, err := b.selectSigners(tx, candidates...)
+	if err != nil {
+		return nil, nil, logical.CodedError(400, err.Error())
+	}
+
+	var keypairs []*keypair.Full
+	for _, signer := range signers {
+		kp, err := keypair.ParseFull(signer.Seed)
+		if err != nil {
+			return nil, nil, err
+		}
+		keypairs = append(keypairs, kp)
+	}
+
+	signedTx, err := tx.Sign(b.networkPassphrase, keypairs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := b.auditTransaction(ctx, req, signedTx, decisions, explanation); err != nil {
+		return nil, nil, err
+	}
+	return signedTx, explanation, nil
+}
+
+// signedTransactionResponse returns the standard response for a signed transaction
+func (b *backend) signedTransactionResponse(tx *txnbuild.Transaction, explanation *SignatureExplanation) (*logical.Response, error) {
+
+	// Convert to base64
+	signedTxBase64, err := tx.Base64()
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the transaction hash
+	txHash, err := tx.HashHex(b.networkPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"source_address":     tx.SourceAccount().AccountID,
+			"account_sequence":   tx.SourceAccount().Sequence,
+			"fee":                tx.MaxFee(),
+			"base_fee":           tx.BaseFee(),
+			"min_time":           tx.Timebounds().MinTime,
+			"max_time":           tx.Timebounds().MaxTime,
+			"transaction_hash":   txHash,
+			"signed_transaction": signedTxBase64,
+			"signatures":         explanation,
+		},
+	}, nil
+}
+
+// submitTransaction submits the signed transaction to the network and returns the result
+func (b *backend) submitTransaction(tx *txnbuild.Transaction) (*logical.Response, error) {
+	result, err := b.horizon.SubmitTransaction(tx)
+	if err != nil {
+		return nil, logical.CodedError(400, "failed to submit transaction: "+errorString(err))
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"source_address":   tx.SourceAccount().AccountID,
+			"transaction_hash": result.Hash,
+			"ledger":           result.Ledger,
+			"successful":       result.Successful,
+		},
+	}, nil
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// readTestOptions reads the transaction options of a request with the given fields
+func readTestOptions(b *backend, raw map[string]interface{}) (*transactionOptions, error) {
+	req := &logical.Request{Storage: &logical.InmemStorage{}, Data: raw}
+	return b.readTransactionOptions(context.Background(), req, &framework.FieldData{
+		Raw:    raw,
+		Schema: transactionFields(map[string]*framework.FieldSchema{}),
+	})
+}
+
+func TestReadTransactionOptions(t *testing.T) {
+	b := Backend()
+	now := time.Now().Unix()
+	signer := randomAccount(t).Address
+
+	opts, err := readTestOptions(b, map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Timeout != 300 || opts.MinTime != 0 || opts.MaxTime != 0 || opts.MinSequenceNumber != nil {
+		t.Fatalf("expected the configured timeout and no preconditions, got %+v", opts)
+	}
+
+	opts, err = readTestOptions(b, map[string]interface{}{
+		"timeout":                 "60",
+		"min_time":                now,
+		"min_ledger":              100,
+		"max_ledger":              200,
+		"min_sequence_number":     "0",
+		"min_sequence_age":        "30",
+		"min_sequence_ledger_gap": 5,
+		"extra_signers":           signer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Timeout != 60 || opts.MinTime != now || opts.MinLedger != 100 || opts.MaxLedger != 200 ||
+		opts.MinSequenceNumber == nil || *opts.MinSequenceNumber != 0 || opts.MinSequenceAge != 30 ||
+		opts.MinSequenceLedgerGap != 5 || len(opts.ExtraSigners) != 1 || opts.ExtraSigners[0] != signer {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	cases := []struct {
+		name     string
+		raw      map[string]interface{}
+		expected string
+	}{
+		{"zero timeout", map[string]interface{}{"timeout": "0"}, "timeout must be positive"},
+		{"max_time in the past", map[string]interface{}{"max_time": now - 1}, "max_time must be in the future"},
+		{"max_time before min_time", map[string]interface{}{"min_time": now + 100, "max_time": now + 50}, "after min_time"},
+		{"min_time after the timeout", map[string]interface{}{"min_time": now + 1000, "timeout": "60"}, "min_time must be before the transaction times out"},
+		{"negative min_time", map[string]interface{}{"min_time": -1}, "must not be negative"},
+		{"negative ledger", map[string]interface{}{"min_ledger": -1}, "min_ledger must not be negative"},
+		{"max_ledger before min_ledger", map[string]interface{}{"min_ledger": 200, "max_ledger": 100}, "max_ledger must be after min_ledger"},
+		{"negative sequence number", map[string]interface{}{"min_sequence_number": "-1"}, "min_sequence_number must be a non-negative integer"},
+		{"invalid sequence number", map[string]interface{}{"min_sequence_number": "one"}, "min_sequence_number must be a non-negative integer"},
+		{"too many extra signers", map[string]interface{}{"extra_signers": signer + "," + signer + "," + signer}, "at most two extra_signers"},
+		{"invalid extra signer", map[string]interface{}{"extra_signers": "SIGNER"}, "invalid extra signer"},
+	}
+	for _, c := range cases {
+		_, err := readTestOptions(b, c.raw)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestTransactionOptions_preconditions(t *testing.T) {
+	before := time.Now().UTC().Unix()
+	minSequenceNumber := int64(41)
+	opts := &transactionOptions{Timeout: 60, MinTime: before, MinSequenceNumber: &minSequenceNumber, MinSequenceAge: 30}
+
+	preconditions := opts.preconditions()
+	if preconditions.TimeBounds.MinTime != before {
+		t.Fatalf("expected min_time to be kept, got %d", preconditions.TimeBounds.MinTime)
+	}
+	if maxTime := preconditions.TimeBounds.MaxTime; maxTime < before+60 || maxTime > time.Now().UTC().Unix()+60 {
+		t.Fatalf("expected the transaction to time out in 60 seconds, got max time %d", maxTime)
+	}
+	if preconditions.LedgerBounds != nil {
+		t.Fatalf("expected no ledger bounds, got %+v", preconditions.LedgerBounds)
+	}
+	if *preconditions.MinSequenceNumber != 41 || preconditions.MinSequenceNumberAge != 30 {
+		t.Fatalf("expected the sequence preconditions to be kept, got %+v", preconditions)
+	}
+
+	// An explicit max_time replaces the timeout
+	opts = &transactionOptions{Timeout: 60, MaxTime: before + 3600, MaxLedger: 500}
+	preconditions = opts.preconditions()
+	if preconditions.TimeBounds.MaxTime != before+3600 {
+		t.Fatalf("expected max_time to be kept, got %d", preconditions.TimeBounds.MaxTime)
+	}
+	if preconditions.LedgerBounds == nil || preconditions.LedgerBounds.MaxLedger != 500 {
+		t.Fatalf("expected the ledger bounds to be set, got %+v", preconditions.LedgerBounds)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stellar/go/clients/stellartoml"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/txnbuild"
+)
+
+type staticStellarToml map[string]*stellartoml.Response
+
+func (s staticStellarToml) GetStellarToml(domain string) (*stellartoml.Response, error) {
+	if resp, ok := s[domain]; ok {
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no stellar.toml for %s", domain)
+}
+
+func TestVerifyURI_signature(t *testing.T) {
+	signer, err := keypair.Random()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := randomAccount(t)
+
+	b := Backend()
+	b.stellarToml = staticStellarToml{
+		"partner.example.com": &stellartoml.Response{UriRequestSigningKey: signer.Address()},
+	}
+
+	uri := sep7Scheme + "pay?destination=" + destination.Address + "&amount=12.5&memo=" + sep7Escape("order 42") +
+		"&network_passphrase=" + sep7Escape(b.networkPassphrase) + "&origin_domain=partner.example.com"
+	signature, err := signer.Sign(sep7Payload(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := uri + "&signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	operation, params, err := b.verifyURI(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation != "pay" || params.Get("amount") != "12.5" || params.Get("memo") != "order 42" {
+		t.Fatalf("unexpected parse result: %s %v", operation, params)
+	}
+
+	// Changing any parameter invalidates the signature
+	tampered := sep7Scheme + "pay?destination=" + destination.Address + "&amount=125&memo=" + sep7Escape("order 42") +
+		"&network_passphrase=" + sep7Escape(b.networkPassphrase) + "&origin_domain=partner.example.com&signature=" +
+		url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	if _, _, err := b.verifyURI(tampered); err == nil {
+		t.Fatal("expected a tampered uri to be refused")
+	}
+
+	if _, _, err := b.verifyURI(uri); err == nil {
+		t.Fatal("expected an unsigned uri to be refused")
+	}
+
+	// Without a network passphrase the uri is for the public network
+	public := sep7Scheme + "pay?destination=" + destination.Address + "&amount=12.5&origin_domain=partner.example.com"
+	signature, err = signer.Sign(sep7Payload(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public += "&signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	if _, _, err := b.verifyURI(public); err == nil {
+		t.Fatal("expected a public network uri to be refused on the test network")
+	}
+}
+
+func TestSignFromURI_approvalKeepsPreconditions(t *testing.T) {
+	b, storage := getTestBackend(t)
+	destination := randomAccount(t)
+	source := randomAccount(t)
+	source.ApprovalThreshold = "100"
+	source.ApprovalTTL = 3600
+	source.Whitelist = []string{destination.Address}
+	putTestAccount(t, storage, "source", source)
+	mockSourceAccount(t, b.(*backend), source)
+
+	// The partner sets no upper time bound, but limits the ledgers the transaction is valid in
+	tx, err := txnbuild.NewTransaction(txnbuild.TransactionParams{
+		SourceAccount:        &txnbuild.SimpleAccount{AccountID: source.Address, Sequence: 1},
+		IncrementSequenceNum: true,
+		Operations:           []txnbuild.Operation{&txnbuild.Payment{Destination: destination.Address, Amount: "500", Asset: txnbuild.NativeAsset{}}},
+		BaseFee:              txnbuild.MinBaseFee,
+		Memo:                 txnbuild.MemoText("invoice 7"),
+		Preconditions: txnbuild.Preconditions{
+			TimeBounds:   txnbuild.NewInfiniteTimeout(),
+			LedgerBounds: &txnbuild.LedgerBounds{MinLedger: 0, MaxLedger: 900000000},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := tx.Base64()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := url.Values{"xdr": {envelope}, "origin_domain": {"partner.example.com"}}
+	resp, err := b.(*backend).signFromURI(context.Background(), &logical.Request{Storage: storage, EntityID: "requester"}, "source", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["status"] != approvalPending {
+		t.Fatalf("expected the transaction to wait for approval, got %v", resp.Data)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "approvals/" + resp.Data["approval_id"].(string) + "/approve",
+		Storage:   storage,
+		EntityID:  "approver",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["status"] != approvalApproved {
+		t.Fatalf("expected the transaction to be approved, got %v", resp.Data)
+	}
+
+	approval, err := b.(*backend).readStoredApproval(context.Background(), &logical.Request{Storage: storage}, resp.Data["approval_id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedTx, err := txnbuild.TransactionFromXDR(approval.SignedTransaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := signedTx.Transaction()
+	if maxTime := signed.Timebounds().MaxTime; maxTime <= time.Now().Unix() {
+		t.Fatalf("expected the signed transaction to expire in the future, got max time %d", maxTime)
+	}
+	if ledgerBounds := signed.ToXDR().LedgerBounds(); ledgerBounds == nil || ledgerBounds.MaxLedger != 900000000 {
+		t.Fatalf("expected the ledger bounds to be kept, got %v", ledgerBounds)
+	}
+	if memo, ok := signed.Memo().(txnbuild.MemoText); !ok || memo != "invoice 7" {
+		t.Fatalf("expected the memo to be kept, got %v", signed.Memo())
+	}
+}
+
+func TestCreatePayment_addressNeedsWhitelist(t *testing.T) {
+	b, storage := getTestBackend(t)
+	storeTestAccount(t, storage, "source")
+	destination := randomAccount(t)
+
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "payments",
+		Data:      map[string]interface{}{"source": "source", "destination": destination.Address, "amount": "10", "assetCode": "native"},
+		Storage:   storage,
+	})
+	if errorCode(err) != 403 {
+		t.Fatalf("expected a payment to an address to be refused without a whitelist, got %v", err)
+	}
+}
@@ -21,7 +21,7 @@ import (
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
-	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/clients/horizonclient"
 	"github.com/stellar/go/support/errors"
 	"math/big"
 	"regexp"
@@ -37,6 +37,16 @@ func contains(stringSlice []string, searchString string) bool {
 	return false
 }
 
+// firstNonEmpty returns the first of the values which is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
 // validNumber returns a valid positive integer
 func validNumber(input string) *big.Int {
 	if input == "" {
@@ -53,7 +63,7 @@ func validNumber(input string) *big.Int {
 // errorString parses the horizon error out of err.
 func errorString(err error, showStackTrace ...bool) string {
 	var errorString string
-	herr, isHorizonError := errors.Cause(err).(*horizon.Error)
+	herr, isHorizonError := errors.Cause(err).(*horizonclient.Error)
 
 	if isHorizonError {
 		errorString += fmt.Sprintf("%v: %v", herr.Problem.Status, herr.Problem.Title)
@@ -0,0 +1,59 @@
+/*
+ * Copyright (c) 2019 ChainFront LLC.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package stellar
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// Test vector 1 of SEP-5
+const sep5TestMnemonic = "illness spike retreat truth genius clock brain pass fit cave bargain toe"
+
+func TestWallet_importDerivesSEP5Accounts(t *testing.T) {
+	b, storage := getTestBackend(t)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "wallets/w",
+		Data:      map[string]interface{}{"mnemonic": sep5TestMnemonic},
+		Storage:   storage,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	expected := []string{
+		"GDRXE2BQUC3AZNPVFSCEZ76NJ3WWL25FYFK6RGZGIEKWE4SOOHSUJUJ6", // m/44'/148'/0'
+		"GBAW5XGWORWVFE2XTJYDTLDHXTY2Q2MO73HYCGB3XMFMQ562Q2W2GJQX", // m/44'/148'/1'
+	}
+	for index, address := range expected {
+		kp, derivedIndex, err := b.(*backend).deriveWalletAccount(context.Background(), storage, "w", index, fmt.Sprintf("account%d", index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if derivedIndex != uint32(index) || kp.Address() != address {
+			t.Fatalf("expected %s at index %d, got %s at index %d", address, index, kp.Address(), derivedIndex)
+		}
+	}
+}